@@ -11,6 +11,7 @@ import {
   Stats,
   TicksAttackInfo,
   TicksAttackQuery,
+  TagRule,
 } from "./types";
 
 function base64DecodeUnicode(str: string) : string {
@@ -23,6 +24,7 @@ function base64DecodeUnicode(str: string) : string {
 
 export const tulipApi = createApi({
   baseQuery: fetchBaseQuery({ baseUrl: API_BASE_PATH }),
+  tagTypes: ["TagRule"],
   endpoints: (builder) => ({
     getServices: builder.query<Service[], void>({
       query: () => "/services",
@@ -117,6 +119,26 @@ export const tulipApi = createApi({
     getTags: builder.query<string[], void>({
       query: () => `/tags`,
     }),
+    getTagRules: builder.query<TagRule[], void>({
+      query: () => `/tag_rules`,
+      providesTags: ["TagRule"],
+    }),
+    saveTagRule: builder.mutation<TagRule, Partial<TagRule>>({
+      query: (rule) => ({
+        url: `/tag_rules`,
+        method: "POST",
+        headers: {
+          Accept: "application/json",
+          "Content-Type": "application/json",
+        },
+        body: rule,
+      }),
+      invalidatesTags: ["TagRule"],
+    }),
+    deleteTagRule: builder.mutation<unknown, number>({
+      query: (id) => ({ url: `/tag_rules/${id}`, method: "DELETE", responseHandler: "text" }),
+      invalidatesTags: ["TagRule"],
+    }),
     getTickInfo: builder.query<TickInfo, void>({
       query: () => `/tick_info`,
     }),
@@ -199,6 +221,9 @@ export const {
   useGetFlowsQuery,
   useLazyGetFlowsQuery,
   useGetTagsQuery,
+  useGetTagRulesQuery,
+  useSaveTagRuleMutation,
+  useDeleteTagRuleMutation,
   useGetTickInfoQuery,
   useLazyToPwnToolsQuery,
   useLazyToFullPythonRequestQuery,
@@ -1,5 +1,6 @@
 import classNames from "classnames";
 import Color from "color";
+import { useGetTagRulesQuery } from "../api";
 
 const computeColorFromString = (str: string) => {
   const hue = Array.from(str).reduce(
@@ -20,6 +21,21 @@ const tagColorMap: Record<string, string> = {
 export function tagToColor(tag: string) {
   return tagColorMap[tag] ?? computeColorFromString(tag);
 }
+
+// Color set on a tag rule of the assembler for this tag, if it is a valid color
+function useTagRuleColor(tag: string) {
+  const { data: rules } = useGetTagRulesQuery();
+  const color = rules?.find((rule) => rule.tag === tag && rule.color)?.color;
+  if (!color) {
+    return undefined;
+  }
+  try {
+    return Color(color).hex();
+  } catch {
+    return undefined;
+  }
+}
+
 interface TagProps {
   tag: string;
   color?: string;
@@ -28,7 +44,8 @@ interface TagProps {
   onClick?: () => void;
 }
 export const Tag = ({ tag, color, disabled = false, excluded = false, onClick }: TagProps) => {
-  var tagBackgroundColor = disabled ? "#eee" : color ?? tagToColor(tag);
+  const ruleColor = useTagRuleColor(tag);
+  var tagBackgroundColor = disabled ? "#eee" : color ?? ruleColor ?? tagToColor(tag);
 
   var tagTextColor = disabled
     ? "#bbb"
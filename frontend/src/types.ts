@@ -63,10 +63,103 @@ export interface FlowsQuery {
   tags_include?: string[];
   tags_exclude?: string[];
   tag_intersection_mode?: "AND" | "OR";
+  // Fields one HTTP exchange of the flow must match, e.g. { method: "POST", path: "/api/login", status: 200 }
+  http?: Partial<HttpExchange>;
+  // Fields the TLS handshake must match, e.g. { sni: "example.com", ja4: "t13d1516h2_8daaf6152771_b0da82dd1658" }
+  tls?: Partial<TlsHandshake>;
+  // Fields one DNS message must match, e.g. { questions: [{ name: "example.com" }] }
+  dns?: Partial<DnsMessage>;
+  // Protocol detected from the content, e.g. "http", "tls", "redis" or "text"
+  protocol?: string;
+  // Team ids of the source and destination address, see the assembler -teams option
+  team_src?: number;
+  team_dst?: number;
+  // Minimum confidence of the checker / attack tag
+  min_confidence?: number;
+  // Fields the SYN of the client must match, e.g. { signature: "4:58+6:0:1460:mss*44,7:mss,sok,ts,nop,ws:df,id+:0" }
+  tcp_fingerprint?: Partial<TcpFingerprint>;
+  // How the TCP connection ended
+  close_reason?: "fin" | "rst" | "timeout" | "reused" | "flushed";
+  // Ticks the flows started in, both inclusive
+  tick_from?: number;
+  tick_to?: number;
   flags?: string[];
   flagids?: string[];
 }
 
+export interface HttpExchange {
+  method: string;
+  host: string;
+  path: string;
+  query: Record<string, string[]>;
+  user_agent: string;
+  cookies: string[];
+  status: number;
+  set_cookies: string[];
+  content_type: string;
+  length: number;
+}
+
+export interface TlsHandshake {
+  sni: string;
+  alpn: string[];
+  alpn_selected: string;
+  versions: string[];
+  version: string;
+  ciphers: string[];
+  cipher: string;
+  ja3: string;
+  ja3s: string;
+  ja4: string;
+  ja4s: string;
+}
+
+export interface DnsMessage {
+  id: number;
+  response: boolean;
+  rcode: string;
+  questions: Partial<DnsRecord>[];
+  answers: Partial<DnsRecord>[];
+  edns_size: number;
+}
+
+export interface DnsRecord {
+  name: string;
+  type: string;
+  ttl: number;
+  data: string;
+}
+
+export interface TcpFingerprint {
+  signature: string;
+  version: number;
+  ttl: number;
+  initial_ttl: number;
+  ip_options: number;
+  mss: number;
+  window: number;
+  scale: number;
+  options: string;
+  quirks: string[];
+  payload: boolean;
+}
+
+// Rule of the assembler that adds a tag to matching flows
+export interface TagRule {
+  id: number;
+  tag: string;
+  // Either a regex or a byte pattern (hex encoded) is set
+  regex: string | null;
+  bytes: string | null;
+  // "c" or "s" to only match data of the client or server, "" for both
+  direction: "" | "c" | "s";
+  // Server port of the service the rule is limited to
+  port: number | null;
+  priority: number;
+  color: string | null;
+  enabled: boolean;
+}
+
 export interface StatsQuery {
   service: string;
   tick_from: number;
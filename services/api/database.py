@@ -16,6 +16,7 @@ import psycopg
 import psycopg_pool
 from psycopg import sql
 from psycopg.rows import class_row, dict_row
+from psycopg.types.json import Jsonb
 
 import configurations
 from json_util import JsonFactory
@@ -33,6 +34,17 @@ class FlowQuery:
     tags_include: list[str] = field(default_factory=list)
     tags_exclude: list[str] = field(default_factory=list)
     tag_intersection_and: bool = False
+    http: dict[str, Any] | None = None
+    tls: dict[str, Any] | None = None
+    dns: dict[str, Any] | None = None
+    protocol: str | None = None
+    team_src: int | None = None
+    team_dst: int | None = None
+    min_confidence: float | None = None
+    tcp_fingerprint: dict[str, Any] | None = None
+    close_reason: str | None = None
+    tick_from: int | None = None
+    tick_to: int | None = None
     limit: int = 1000
 
 
@@ -54,6 +66,24 @@ class Flow:
     packets_size: int
     flags_in: int
     flags_out: int
+    size_client: int
+    size_server: int
+    overflow: list[dict[str, Any]]
+    tunnel: list[dict[str, Any]]
+    http: list[dict[str, Any]]
+    tls: dict[str, Any] | None
+    dns: list[dict[str, Any]]
+    protocol: str
+    team_src: int | None
+    team_dst: int | None
+    confidence: float | None
+    tcp_fingerprint: dict[str, Any] | None
+    close_reason: str
+    handshake: bool
+    retransmissions: int
+    out_of_order: int
+    tick: int | None
+    flag_ticks: dict[str, int]
     signatures: list[Signature]
     tags: list[str]
     flags: list[str]
@@ -76,6 +106,7 @@ class FlowItem(JsonFactory):
     time: datetime
     direction: str
     data: bytes
+    meta: dict[str, Any] = field(default_factory=dict)
 
     def to_json(self) -> Any:
         result = JsonFactory.to_json(self)
@@ -97,6 +128,20 @@ class FlowDetail(Flow):
         return b"".join(self.item_data(kind))
 
 
+@dataclass(slots=True, kw_only=True)
+class TagRule:
+    id: int | None = None
+    tag: str
+    # Either a regex or a byte pattern (hex encoded)
+    regex: str | None = None
+    bytes: str | None = None
+    direction: str = ""
+    port: int | None = None
+    priority: int = 0
+    color: str | None = None
+    enabled: bool = True
+
+
 @dataclass(slots=True, kw_only=True)
 class StatsQuery:
     service: str | None = None
@@ -174,6 +219,52 @@ class Connection(psycopg.Connection):
             parameters["tags_exclude"] = query.tags_exclude
             conditions.append(sql.SQL("NOT f.tags ?| %(tags_exclude)s"))
 
+        if query.http:
+            # One exchange has to contain all given fields
+            parameters["http"] = Jsonb([query.http])
+            conditions.append(sql.SQL("f.http @> %(http)s"))
+
+        if query.tls:
+            parameters["tls"] = Jsonb(query.tls)
+            conditions.append(sql.SQL("f.tls @> %(tls)s"))
+
+        if query.dns:
+            # One message has to contain all given fields
+            parameters["dns"] = Jsonb([query.dns])
+            conditions.append(sql.SQL("f.dns @> %(dns)s"))
+
+        if query.protocol:
+            parameters["protocol"] = query.protocol
+            conditions.append(sql.SQL("f.protocol = %(protocol)s"))
+
+        if query.team_src is not None:
+            parameters["team_src"] = query.team_src
+            conditions.append(sql.SQL("f.team_src = %(team_src)s"))
+        if query.team_dst is not None:
+            parameters["team_dst"] = query.team_dst
+            conditions.append(sql.SQL("f.team_dst = %(team_dst)s"))
+
+        if query.min_confidence is not None:
+            # Only meaningful together with the checker or attack tag
+            parameters["min_confidence"] = query.min_confidence
+            conditions.append(sql.SQL("f.confidence >= %(min_confidence)s"))
+
+        if query.tcp_fingerprint:
+            parameters["tcp_fingerprint"] = Jsonb(query.tcp_fingerprint)
+            conditions.append(sql.SQL("f.tcp_fingerprint @> %(tcp_fingerprint)s"))
+
+        if query.close_reason:
+            parameters["close_reason"] = query.close_reason
+            conditions.append(sql.SQL("f.close_reason = %(close_reason)s"))
+
+        # Both ends are inclusive, flows without a tick never match
+        if query.tick_from is not None:
+            parameters["tick_from"] = query.tick_from
+            conditions.append(sql.SQL("f.tick >= %(tick_from)s"))
+        if query.tick_to is not None:
+            parameters["tick_to"] = query.tick_to
+            conditions.append(sql.SQL("f.tick <= %(tick_to)s"))
+
         if query.regex_insensitive:
             parameters["regex_insensitive"] = query.regex_insensitive.pattern
             text = """
@@ -349,3 +440,50 @@ class Connection(psycopg.Connection):
         with self.cursor(row_factory=dict_row) as cursor:
             tags = cursor.execute("SELECT name FROM tag ORDER BY sort ASC").fetchall()
             return [t["name"] for t in tags]
+
+    def tag_rule_list(self) -> list[TagRule]:
+        with self.cursor(row_factory=class_row(TagRule)) as cursor:
+            return cursor.execute(
+                """
+                SELECT id, tag, regex, encode(bytes, 'hex') AS bytes, direction,
+                    port, priority, color, enabled
+                FROM tag_rule
+                ORDER BY priority DESC, id ASC
+                """
+            ).fetchall()
+
+    def tag_rule_save(self, rule: TagRule) -> int:
+        """Insert a new rule or update the one with the same id, the assembler picks it up within seconds"""
+        parameters = {
+            "id": rule.id,
+            "tag": rule.tag,
+            "regex": rule.regex,
+            "bytes": bytes.fromhex(rule.bytes) if rule.bytes is not None else None,
+            "direction": rule.direction,
+            "port": rule.port,
+            "priority": rule.priority,
+            "color": rule.color,
+            "enabled": rule.enabled,
+        }
+        if rule.id is None:
+            sql_query = """
+                INSERT INTO tag_rule (tag, regex, bytes, direction, port, priority, color, enabled)
+                VALUES (%(tag)s, %(regex)s, %(bytes)s, %(direction)s, %(port)s, %(priority)s, %(color)s, %(enabled)s)
+                RETURNING id
+            """
+        else:
+            sql_query = """
+                UPDATE tag_rule
+                SET tag = %(tag)s, regex = %(regex)s, bytes = %(bytes)s, direction = %(direction)s,
+                    port = %(port)s, priority = %(priority)s, color = %(color)s, enabled = %(enabled)s
+                WHERE id = %(id)s
+                RETURNING id
+            """
+
+        row = self.execute(sql_query, parameters).fetchone()
+        if row is None:
+            raise KeyError(rule.id)
+        return row[0]
+
+    def tag_rule_delete(self, rule_id: int) -> None:
+        self.execute("DELETE FROM tag_rule WHERE id = %(id)s", {"id": rule_id})
@@ -30,6 +30,7 @@ import uuid
 from flask import Flask, Response, send_file
 from requests import get
 import dateutil.parser
+import psycopg
 from ipaddress import ip_network
 
 from configurations import (
@@ -104,6 +105,17 @@ def query():
             tags_include=[str(elem) for elem in query.get("tags_include", [])],
             tags_exclude=[str(elem) for elem in query.get("tags_exclude", [])],
             tag_intersection_and=query.get("tag_intersection_mode", "").lower() == "and",
+            http=query.get("http"),
+            tls=query.get("tls"),
+            dns=query.get("dns"),
+            protocol=query.get("protocol"),
+            team_src=query.get("team_src"),
+            team_dst=query.get("team_dst"),
+            min_confidence=query.get("min_confidence"),
+            tcp_fingerprint=query.get("tcp_fingerprint"),
+            close_reason=query.get("close_reason"),
+            tick_from=query.get("tick_from"),
+            tick_to=query.get("tick_to"),
         )
     except re.error as error:
         return return_json_response(
@@ -157,6 +169,52 @@ def getTags():
     return return_json_response(tags)
 
 
+@application.route("/tag_rules")
+def getTagRules():
+    with db.connection() as c:
+        rules = c.tag_rule_list()
+    return return_json_response(rules)
+
+
+@application.route("/tag_rules", methods=["POST"])
+def saveTagRule():
+    query = request.get_json()
+    try:
+        rule = database.TagRule(
+            id=query.get("id"),
+            tag=str(query["tag"]),
+            regex=query.get("regex"),
+            bytes=query.get("bytes"),
+            direction=query.get("direction", ""),
+            port=query.get("port"),
+            priority=int(query.get("priority", 0)),
+            color=query.get("color"),
+            enabled=bool(query.get("enabled", True)),
+        )
+        if (rule.regex is None) == (rule.bytes is None):
+            raise ValueError("exactly one of regex and bytes has to be set")
+        if rule.bytes is not None:
+            bytes.fromhex(rule.bytes)
+
+        with db.connection() as c:
+            rule.id = c.tag_rule_save(rule)
+    except (KeyError, ValueError, psycopg.errors.CheckViolation) as error:
+        return return_json_response(
+            {
+                "error": str(error),
+            },
+            status=400,
+        )
+    return return_json_response(rule)
+
+
+@application.route("/tag_rules/<int:id>", methods=["DELETE"])
+def deleteTagRule(id):
+    with db.connection() as c:
+        c.tag_rule_delete(id)
+    return "ok!"
+
+
 @application.route("/star", methods=["POST"])
 def setStar():
     query = request.get_json()
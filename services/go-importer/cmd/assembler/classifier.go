@@ -0,0 +1,382 @@
+package main
+
+import (
+	"go-importer/internal/pkg/db"
+
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Heuristics of the classifier as read from -classifier, e.g.
+//
+//	{
+//		"subnets": ["10.10.0.0/24"],
+//		"ttls": [62],
+//		"tcp_options": ["mss,sok,ts,nop,ws"],
+//		"user_agents": ["^python-requests/"],
+//		"weights": {"user_agent": 3},
+//		"threshold": 0.8,
+//		"session_timeout": 900
+//	}
+type ClassifierConfig struct {
+	// Addresses or CIDRs of the checker, the gameserver ranges of -teams count too
+	Subnets []string `json:"subnets"`
+	// TTLs of the SYNs of the checker as they arrive, i.e. after the hops to the capture
+	Ttls []uint8 `json:"ttls"`
+	// TCP option layouts of the SYNs of the checker, see tcpOptionLayout
+	TcpOptions []string `json:"tcp_options"`
+	// Regexes matched against the user agents of HTTP requests of the checker
+	UserAgents []string `json:"user_agents"`
+	// Overrides of classifierWeights
+	Weights map[string]float64 `json:"weights"`
+	// Minimum confidence for a flow to be tagged, between 0.5 and 1
+	Threshold float64 `json:"threshold"`
+	// Seconds the flags of a session are remembered after its last flow with a flag
+	SessionTimeout float64 `json:"session_timeout"`
+}
+
+// How much each heuristic counts, in log-odds of the flow coming from the checker
+var classifierWeights = map[string]float64{
+	"subnet":         4,
+	"team":           2,
+	"ttl":            1,
+	"tcp_options":    1.5,
+	"user_agent":     2,
+	"tls":            1.5,
+	"flag_in":        1.5,
+	"flag_out":       2,
+	"flag_roundtrip": 3,
+	"flagid":         1,
+}
+
+const classifierThreshold = 0.75
+const classifierSessionTimeout = 30 * time.Minute
+
+type Classifier struct {
+	subnets    []netip.Prefix
+	ttls       map[uint8]bool
+	tcpOptions map[string]bool
+	userAgents []*regexp.Regexp
+	weights    map[string]float64
+	threshold  float64
+	sessions   *classifierSessions
+}
+
+var classifier *Classifier
+
+func NewClassifier(config ClassifierConfig) (*Classifier, error) {
+	classifier := &Classifier{
+		ttls:       map[uint8]bool{},
+		tcpOptions: map[string]bool{},
+		weights:    map[string]float64{},
+		threshold:  config.Threshold,
+		sessions:   newClassifierSessions(classifierSessionTimeout),
+	}
+
+	for _, raw := range config.Subnets {
+		prefix, err := parseTeamPrefix(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subnet: %w", err)
+		}
+		classifier.subnets = append(classifier.subnets, prefix)
+	}
+	for _, ttl := range config.Ttls {
+		classifier.ttls[ttl] = true
+	}
+	for _, options := range config.TcpOptions {
+		classifier.tcpOptions[options] = true
+	}
+	for _, raw := range config.UserAgents {
+		userAgent, err := regexp.Compile(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user agent regex: %w", err)
+		}
+		classifier.userAgents = append(classifier.userAgents, userAgent)
+	}
+
+	for name, weight := range classifierWeights {
+		classifier.weights[name] = weight
+	}
+	for name, weight := range config.Weights {
+		if _, ok := classifierWeights[name]; !ok {
+			return nil, fmt.Errorf("unknown heuristic %q", name)
+		}
+		classifier.weights[name] = weight
+	}
+
+	if classifier.threshold == 0 {
+		classifier.threshold = classifierThreshold
+	}
+	if classifier.threshold < 0.5 || classifier.threshold > 1 {
+		return nil, fmt.Errorf("threshold %v is not between 0.5 and 1", classifier.threshold)
+	}
+
+	if config.SessionTimeout < 0 {
+		return nil, fmt.Errorf("session timeout %v is negative", config.SessionTimeout)
+	}
+	if config.SessionTimeout != 0 {
+		classifier.sessions.timeout = time.Duration(config.SessionTimeout * float64(time.Second))
+	}
+	return classifier, nil
+}
+
+func LoadClassifier(path string) (*Classifier, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config ClassifierConfig
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, err
+	}
+	return NewClassifier(config)
+}
+
+// Tag a flow as checker or attack traffic with the confidence of that guess.
+// Needs the team, flag and flagid tags, so it has to run after those are applied.
+func ApplyClassifier(flow *db.FlowEntry) {
+	if classifier == nil {
+		return
+	}
+
+	// Log-odds of the flow coming from the checker
+	score := 0.0
+	evidence := false
+	for name, checker := range classifier.evidence(flow) {
+		evidence = true
+		if checker {
+			score += classifier.weights[name]
+		} else {
+			score -= classifier.weights[name]
+		}
+	}
+	if !evidence {
+		return
+	}
+
+	tag := "checker"
+	confidence := 1 / (1 + math.Exp(-score))
+	if score < 0 {
+		tag = "attack"
+		confidence = 1 - confidence
+	}
+	if confidence < classifier.threshold {
+		return
+	}
+
+	flow.Confidence = &confidence
+	if !contains(flow.Tags, tag) {
+		flow.Tags = append(flow.Tags, tag)
+	}
+}
+
+// Outcome of every heuristic that applies to the flow, true if it points towards the checker
+func (classifier *Classifier) evidence(flow *db.FlowEntry) map[string]bool {
+	evidence := map[string]bool{}
+
+	if contains(flow.Tags, "gameserver") || classifier.fromSubnet(flow.Src_ip) {
+		evidence["subnet"] = true
+	} else if contains(flow.Tags, "enemy") {
+		evidence["team"] = false
+	}
+
+	if flow.Tcp_fingerprint != nil {
+		if len(classifier.ttls) != 0 {
+			evidence["ttl"] = classifier.ttls[flow.Tcp_fingerprint.Ttl]
+		}
+		if len(classifier.tcpOptions) != 0 {
+			evidence["tcp_options"] = classifier.tcpOptions[flow.Tcp_fingerprint.Options]
+		}
+	}
+
+	if len(classifier.userAgents) != 0 {
+		for _, exchange := range flow.Http {
+			if exchange.UserAgent == "" {
+				continue
+			}
+			matched := false
+			for _, userAgent := range classifier.userAgents {
+				if userAgent.MatchString(exchange.UserAgent) {
+					matched = true
+					break
+				}
+			}
+			// A single foreign user agent is enough to give it away
+			if checker, ok := evidence["user_agent"]; !ok || checker {
+				evidence["user_agent"] = matched
+			}
+		}
+	}
+
+	// The fingerprints of the checker are learned, see TlsClientStats
+	if contains(flow.Tags, "tls-unusual") {
+		evidence["tls"] = false
+	}
+
+	// The checker retrieves the flags it placed itself, attackers only take them
+	if classifier.flagRoundtrip(flow) {
+		evidence["flag_roundtrip"] = true
+	} else if contains(flow.Tags, "flag-out") {
+		evidence["flag_out"] = false
+	} else if contains(flow.Tags, "flag-in") {
+		evidence["flag_in"] = true
+	}
+	// Flag ids are public so attackers can find the flags, the checker sends them
+	// along with the flag it places
+	if contains(flow.Tags, "flagid-in") && !contains(flow.Tags, "flag-in") {
+		evidence["flagid"] = false
+	}
+
+	return evidence
+}
+
+func (classifier *Classifier) fromSubnet(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range classifier.subnets {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the server sends back a flag the client sent earlier in the flow, or
+// in an earlier flow of the same session. The checker often places a flag and
+// retrieves it in separate connections, which only share a session if
+// -http-session-tracking finds the same session keys in both. Without those,
+// only roundtrips within a single flow are recognized.
+func (classifier *Classifier) flagRoundtrip(flow *db.FlowEntry) bool {
+	if flagRegex == nil || (!contains(flow.Tags, "flag-in") && !contains(flow.Tags, "flag-out")) {
+		return false
+	}
+
+	sent := flowFlags(flow, "c", false)
+	returned := flowFlags(flow, "s", true)
+	if flagsReturned(sent, returned) {
+		return true
+	}
+
+	if len(flow.Fingerprints) == 0 {
+		return false
+	}
+	return classifier.sessions.roundtrip(flow.Fingerprints, flow.Time, sent, returned)
+}
+
+// Flags in the items of one direction with the time they were first seen, or last
+// seen if latest is set. Decoded items are appended after the raw ones, so this
+// goes by time instead of order.
+func flowFlags(flow *db.FlowEntry, from string, latest bool) map[string]time.Time {
+	flags := map[string]time.Time{}
+	for _, item := range flow.Flow {
+		if item.From != from {
+			continue
+		}
+		for _, match := range flagRegex.FindAll(item.Data, -1) {
+			seen, ok := flags[string(match)]
+			if !ok || (latest && seen.Before(item.Time)) || (!latest && item.Time.Before(seen)) {
+				flags[string(match)] = item.Time
+			}
+		}
+	}
+	return flags
+}
+
+// Whether any flag was returned at or after the time it was sent
+func flagsReturned(sent map[string]time.Time, returned map[string]time.Time) bool {
+	for flag, at := range returned {
+		if first, ok := sent[flag]; ok && !at.Before(first) {
+			return true
+		}
+	}
+	return false
+}
+
+// Flags sent and returned in every session, by session fingerprint. Flows are
+// completed out of order, so a roundtrip is recognized in whichever of its flows
+// comes last.
+type classifierSessions struct {
+	mutex    sync.Mutex
+	sessions map[uint64]*classifierSession
+	timeout  time.Duration
+	// Time of the newest flow, sessions are expired relative to capture time
+	latest time.Time
+	pruned time.Time
+}
+
+type classifierSession struct {
+	// First time every flag was sent by the client
+	sent map[string]time.Time
+	// Last time every flag was returned by the server
+	returned map[string]time.Time
+	seen     time.Time
+}
+
+func newClassifierSessions(timeout time.Duration) *classifierSessions {
+	return &classifierSessions{
+		sessions: map[uint64]*classifierSession{},
+		timeout:  timeout,
+	}
+}
+
+// Remember the flags of a flow and check whether they complete a roundtrip with
+// the flags of its sessions
+func (sessions *classifierSessions) roundtrip(fingerprints []uint64, at time.Time, sent map[string]time.Time, returned map[string]time.Time) bool {
+	if len(sent) == 0 && len(returned) == 0 {
+		return false
+	}
+
+	sessions.mutex.Lock()
+	defer sessions.mutex.Unlock()
+
+	found := false
+	for _, fingerprint := range fingerprints {
+		session, ok := sessions.sessions[fingerprint]
+		if !ok {
+			session = &classifierSession{sent: map[string]time.Time{}, returned: map[string]time.Time{}}
+			sessions.sessions[fingerprint] = session
+		}
+
+		found = found || flagsReturned(session.sent, returned) || flagsReturned(sent, session.returned)
+
+		for flag, first := range sent {
+			if known, ok := session.sent[flag]; !ok || first.Before(known) {
+				session.sent[flag] = first
+			}
+		}
+		for flag, last := range returned {
+			if known, ok := session.returned[flag]; !ok || known.Before(last) {
+				session.returned[flag] = last
+			}
+		}
+		if session.seen.Before(at) {
+			session.seen = at
+		}
+	}
+
+	if sessions.latest.Before(at) {
+		sessions.latest = at
+	}
+	sessions.prune()
+	return found
+}
+
+// Forget sessions without flags for longer than the timeout, at most once per timeout
+func (sessions *classifierSessions) prune() {
+	if sessions.latest.Sub(sessions.pruned) < sessions.timeout {
+		return
+	}
+	sessions.pruned = sessions.latest
+
+	for fingerprint, session := range sessions.sessions {
+		if sessions.latest.Sub(session.seen) > sessions.timeout {
+			delete(sessions.sessions, fingerprint)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"go-importer/internal/pkg/db"
+
+	"regexp"
+	"testing"
+	"time"
+)
+
+func testClassifierFlow(at time.Time, tags []string, fingerprints []uint64, client string, server string) *db.FlowEntry {
+	return &db.FlowEntry{
+		Time:         at,
+		Tags:         tags,
+		Fingerprints: fingerprints,
+		Flow: []db.FlowItem{
+			{Kind: "raw", From: "c", Data: []byte(client), Time: at},
+			{Kind: "raw", From: "s", Data: []byte(server), Time: at.Add(time.Millisecond)},
+		},
+	}
+}
+
+func TestClassifierFlagRoundtripInSession(t *testing.T) {
+	previous := flagRegex
+	flagRegex = regexp.MustCompile(`FLAG\{[a-z]+\}`)
+	defer func() { flagRegex = previous }()
+
+	classifier, err := NewClassifier(ClassifierConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 11, 30, 13, 0, 0, 0, time.UTC)
+
+	// The checker places the flag in one connection and retrieves it in another
+	place := testClassifierFlow(start, []string{"flag-in"}, []uint64{1}, "PUT FLAG{checker}", "OK")
+	if classifier.flagRoundtrip(place) {
+		t.Error("placing the flag is a roundtrip on its own")
+	}
+	retrieve := testClassifierFlow(start.Add(time.Minute), []string{"flag-out"}, []uint64{1}, "GET", "FLAG{checker}")
+	if !classifier.flagRoundtrip(retrieve) {
+		t.Error("retrieving the flag in the same session is no roundtrip")
+	}
+
+	// Someone else taking the flag is not part of the session
+	steal := testClassifierFlow(start.Add(2*time.Minute), []string{"flag-out"}, []uint64{2}, "GET", "FLAG{checker}")
+	if classifier.flagRoundtrip(steal) {
+		t.Error("retrieving the flag in another session is a roundtrip")
+	}
+
+	// Flows completed out of order are recognized by the later one
+	retrieveFirst := testClassifierFlow(start.Add(4*time.Minute), []string{"flag-out"}, []uint64{3}, "GET", "FLAG{other}")
+	if classifier.flagRoundtrip(retrieveFirst) {
+		t.Error("retrieving an unknown flag is a roundtrip")
+	}
+	placeLater := testClassifierFlow(start.Add(3*time.Minute), []string{"flag-in"}, []uint64{3}, "PUT FLAG{other}", "OK")
+	if !classifier.flagRoundtrip(placeLater) {
+		t.Error("placing a flag that was retrieved later is no roundtrip")
+	}
+
+	// Sessions are forgotten after the timeout
+	late := testClassifierFlow(start.Add(time.Hour), []string{"flag-out"}, []uint64{1}, "GET", "FLAG{checker}")
+	if classifier.flagRoundtrip(testClassifierFlow(start.Add(time.Hour), []string{"flag-in"}, []uint64{4}, "PUT FLAG{new}", "OK")) {
+		t.Error("placing a new flag is a roundtrip")
+	}
+	if classifier.flagRoundtrip(late) {
+		t.Error("session was not forgotten after the timeout")
+	}
+}
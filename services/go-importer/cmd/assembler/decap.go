@@ -0,0 +1,123 @@
+package main
+
+import (
+	"go-importer/internal/pkg/db"
+
+	"encoding/binary"
+	"errors"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+/*
+ * Link types
+ */
+
+// gopacket only keeps the lower byte of the link type, so LINKTYPE_LINUX_SLL2 (276) shows up as 20
+const linkTypeLinuxSLL2Truncated = layers.LinkType(276 & 0xff)
+
+// Pick the decoder for the link type of a capture
+func linkTypeDecoder(linktype layers.LinkType) gopacket.Decoder {
+	switch linktype {
+	case layers.LinkTypeIPv4:
+		return layers.LayerTypeIPv4
+	case layers.LinkTypeIPv6:
+		return layers.LayerTypeIPv6
+	case linkTypeLinuxSLL2Truncated:
+		return gopacket.DecodeFunc(decodeLinuxSLL2)
+	default:
+		return linktype
+	}
+}
+
+// Linux cooked capture v2, as seen on "any" and most VPN interfaces.
+// The header carries nothing we need, so skip straight to the payload.
+func decodeLinuxSLL2(data []byte, p gopacket.PacketBuilder) error {
+	if len(data) < 20 {
+		return errors.New("Linux SLL2 header too short")
+	}
+
+	protocol := layers.EthernetType(binary.BigEndian.Uint16(data[0:2]))
+	return protocol.Decode(data[20:], p)
+}
+
+/*
+ * Tunnels
+ */
+
+// Find the network layer flows should be keyed on and the layers following it.
+// With decapsulation enabled this is the innermost IP header, and everything
+// wrapped around it is returned as tunnel metadata.
+func decapsulate(packet gopacket.Packet) (gopacket.NetworkLayer, []gopacket.Layer, []db.FlowTunnel) {
+	packetLayers := packet.Layers()
+	tunnels := []db.FlowTunnel{}
+	inner := -1
+	// Tunnel header waiting for the addresses of the IP header carrying it
+	pending := -1
+
+	for i, layer := range packetLayers {
+		switch layer := layer.(type) {
+		case *layers.Dot1Q:
+			tunnels = append(tunnels, db.FlowTunnel{Type: "vlan", Id: uint32(layer.VLANIdentifier)})
+		case *layers.GRE:
+			pending = len(tunnels)
+			tunnels = append(tunnels, db.FlowTunnel{Type: "gre", Id: layer.Key})
+		case *layers.VXLAN:
+			pending = len(tunnels)
+			tunnels = append(tunnels, db.FlowTunnel{Type: "vxlan", Id: layer.VNI})
+		case *layers.Geneve:
+			pending = len(tunnels)
+			tunnels = append(tunnels, db.FlowTunnel{Type: "geneve", Id: layer.VNI})
+		case *layers.IPv4, *layers.IPv6:
+			if inner == -1 {
+				inner = i
+				continue
+			}
+			if !*decapsulation {
+				continue
+			}
+
+			// Nested IP header, so the previous one was the outer one
+			src, dst := packetLayers[inner].(gopacket.NetworkLayer).NetworkFlow().Endpoints()
+			if pending == -1 {
+				pending = len(tunnels)
+				tunnels = append(tunnels, db.FlowTunnel{Type: "ip"})
+			}
+			tunnels[pending].Src = src.String()
+			tunnels[pending].Dst = dst.String()
+			pending = -1
+			inner = i
+		}
+	}
+
+	if inner == -1 {
+		return packet.NetworkLayer(), nil, tunnels[:0]
+	}
+
+	if !*decapsulation {
+		tunnels = tunnels[:0]
+	}
+
+	return packetLayers[inner].(gopacket.NetworkLayer), packetLayers[inner+1:], tunnels
+}
+
+// First transport layer in the given layers
+func transportLayer(packetLayers []gopacket.Layer) gopacket.TransportLayer {
+	for _, layer := range packetLayers {
+		if transport, ok := layer.(gopacket.TransportLayer); ok {
+			return transport
+		}
+	}
+	return nil
+}
+
+// First layer of the given type
+func findLayer(packetLayers []gopacket.Layer, layerType gopacket.LayerType) gopacket.Layer {
+	for _, layer := range packetLayers {
+		if layer.LayerType() == layerType {
+			return layer
+		}
+	}
+	return nil
+}
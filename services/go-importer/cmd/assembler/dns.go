@@ -0,0 +1,259 @@
+package main
+
+import (
+	"go-importer/internal/pkg/db"
+
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Ports DNS is parsed on, see -dns-ports
+var dnsPorts = map[uint16]bool{}
+
+// Parse a comma separated list of ports, these also get the dns session rule for UDP
+func ParseDnsPorts(raw string) error {
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		port, err := strconv.ParseUint(part, 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid port %q: %w", part, err)
+		}
+		dnsPorts[uint16(port)] = true
+	}
+	return nil
+}
+
+type dnsMessage struct {
+	// Flow item in which the message ends
+	item int
+	dns  *layers.DNS
+}
+
+// Decode the DNS messages of a flow into metadata and readable "dns" items
+func ParseDnsFlow(flow *db.FlowEntry) {
+	if !dnsPorts[flow.Dst_port] && !dnsPorts[flow.Src_port] {
+		return
+	}
+
+	var messages []dnsMessage
+	if contains(flow.Tags, "tcp") {
+		// Both directions are a stream of messages prefixed with their length
+		messages = append(dnsTcpMessages(flow, "c"), dnsTcpMessages(flow, "s")...)
+	} else {
+		kind := flowDataKind(flow)
+		for i, item := range flow.Flow {
+			if item.Kind != kind {
+				continue
+			}
+			if dns := dnsDecode(item.Data); dns != nil {
+				messages = append(messages, dnsMessage{i, dns})
+			}
+		}
+	}
+
+	if len(messages) == 0 {
+		return
+	}
+
+	// Sort by item, keeping the order of messages within the same item
+	ordered := make([][]dnsMessage, len(flow.Flow))
+	for _, message := range messages {
+		ordered[message.item] = append(ordered[message.item], message)
+	}
+
+	items := []db.FlowItem{}
+	for i, messages := range ordered {
+		if len(messages) == 0 {
+			continue
+		}
+
+		var text strings.Builder
+		for _, message := range messages {
+			flow.Dns = append(flow.Dns, dnsMetadata(message.dns))
+			dnsWrite(&text, message.dns)
+		}
+
+		items = append(items, db.FlowItem{
+			Kind: "dns",
+			From: flow.Flow[i].From,
+			Data: []byte(text.String()),
+			Time: flow.Flow[i].Time,
+		})
+	}
+
+	appendFlowItems(flow, items)
+
+	if !contains(flow.Tags, "dns") {
+		flow.Tags = append(flow.Tags, "dns")
+	}
+}
+
+func dnsDecode(data []byte) *layers.DNS {
+	dns := &layers.DNS{}
+	if err := dns.DecodeFromBytes(data, gopacket.NilDecodeFeedback); err != nil {
+		return nil
+	}
+	return dns
+}
+
+// Split one direction of a TCP flow into messages, stops at the first gap or invalid message
+func dnsTcpMessages(flow *db.FlowEntry, from string) []dnsMessage {
+	messages := []dnsMessage{}
+	buffer := []byte{}
+
+	kind := flowDataKind(flow)
+	for i, item := range flow.Flow {
+		if item.Kind != kind || item.From != from {
+			continue
+		}
+		if item.Meta.Gap != nil {
+			break
+		}
+
+		buffer = append(buffer, item.Data...)
+		for len(buffer) >= 2 {
+			length := int(binary.BigEndian.Uint16(buffer))
+			if len(buffer) < 2+length {
+				break
+			}
+
+			dns := dnsDecode(buffer[2 : 2+length])
+			if dns == nil {
+				return messages
+			}
+			messages = append(messages, dnsMessage{i, dns})
+			buffer = buffer[2+length:]
+		}
+	}
+
+	return messages
+}
+
+func dnsMetadata(dns *layers.DNS) db.FlowDnsMessage {
+	message := db.FlowDnsMessage{
+		Id:       dns.ID,
+		Response: dns.QR,
+	}
+	if dns.QR {
+		message.Rcode = dnsRcode(dns.ResponseCode)
+	}
+
+	for _, question := range dns.Questions {
+		message.Questions = append(message.Questions, db.FlowDnsRecord{
+			Name: string(question.Name),
+			Type: question.Type.String(),
+		})
+	}
+	for _, answer := range dns.Answers {
+		message.Answers = append(message.Answers, db.FlowDnsRecord{
+			Name: string(answer.Name),
+			Type: answer.Type.String(),
+			Ttl:  answer.TTL,
+			Data: dnsRecordData(&answer),
+		})
+	}
+	for _, additional := range dns.Additionals {
+		// The class of an OPT record is the UDP payload size, see RFC 6891
+		if additional.Type == layers.DNSTypeOPT {
+			message.EdnsSize = uint16(additional.Class)
+		}
+	}
+
+	return message
+}
+
+// Mnemonic of a response code as used by dig, gopacket only has descriptions
+func dnsRcode(code layers.DNSResponseCode) string {
+	switch code {
+	case layers.DNSResponseCodeNoErr:
+		return "NOERROR"
+	case layers.DNSResponseCodeFormErr:
+		return "FORMERR"
+	case layers.DNSResponseCodeServFail:
+		return "SERVFAIL"
+	case layers.DNSResponseCodeNXDomain:
+		return "NXDOMAIN"
+	case layers.DNSResponseCodeNotImp:
+		return "NOTIMP"
+	case layers.DNSResponseCodeRefused:
+		return "REFUSED"
+	}
+	return code.String()
+}
+
+// Presentation format of the data of a record
+func dnsRecordData(record *layers.DNSResourceRecord) string {
+	switch record.Type {
+	case layers.DNSTypeA, layers.DNSTypeAAAA:
+		return record.IP.String()
+	case layers.DNSTypeNS:
+		return string(record.NS)
+	case layers.DNSTypeCNAME:
+		return string(record.CNAME)
+	case layers.DNSTypePTR:
+		return string(record.PTR)
+	case layers.DNSTypeMX:
+		return fmt.Sprintf("%d %s", record.MX.Preference, record.MX.Name)
+	case layers.DNSTypeSRV:
+		return fmt.Sprintf("%d %d %d %s", record.SRV.Priority, record.SRV.Weight, record.SRV.Port, record.SRV.Name)
+	case layers.DNSTypeSOA:
+		soa := record.SOA
+		return fmt.Sprintf("%s %s %d %d %d %d %d", soa.MName, soa.RName, soa.Serial, soa.Refresh, soa.Retry, soa.Expire, soa.Minimum)
+	case layers.DNSTypeTXT:
+		parts := make([]string, len(record.TXTs))
+		for i, txt := range record.TXTs {
+			parts[i] = strconv.Quote(string(txt))
+		}
+		return strings.Join(parts, " ")
+	case layers.DNSTypeURI:
+		return fmt.Sprintf("%d %d %q", record.URI.Priority, record.URI.Weight, record.URI.Target)
+	}
+	return hex.EncodeToString(record.Data)
+}
+
+// Write a message similar to the output of dig
+func dnsWrite(text *strings.Builder, dns *layers.DNS) {
+	if dns.QR {
+		fmt.Fprintf(text, ";; response id %d %s\n", dns.ID, dnsRcode(dns.ResponseCode))
+	} else {
+		fmt.Fprintf(text, ";; %s id %d\n", strings.ToLower(dns.OpCode.String()), dns.ID)
+	}
+
+	for _, question := range dns.Questions {
+		fmt.Fprintf(text, ";%s. %s %s\n", question.Name, question.Class, question.Type)
+	}
+
+	sections := []struct {
+		name    string
+		records []layers.DNSResourceRecord
+	}{
+		{"answer", dns.Answers},
+		{"authority", dns.Authorities},
+		{"additional", dns.Additionals},
+	}
+	for _, section := range sections {
+		if len(section.records) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(text, ";; %s\n", section.name)
+		for _, record := range section.records {
+			if record.Type == layers.DNSTypeOPT {
+				fmt.Fprintf(text, "; EDNS udp=%d\n", uint16(record.Class))
+				continue
+			}
+			fmt.Fprintf(text, "%s. %d %s %s %s\n", record.Name, record.TTL, record.Class, record.Type, dnsRecordData(&record))
+		}
+	}
+	text.WriteString("\n")
+}
@@ -3,150 +3,432 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/flate"
 	"compress/gzip"
+	"compress/zlib"
 	"go-importer/internal/pkg/db"
-	"hash/crc32"
 	"io"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
+	"strconv"
+	"strings"
 
 	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
 )
 
-func AddFingerprints(cookies []*http.Cookie, fingerPrints map[uint32]bool) {
+func AddFingerprints(cookies []*http.Cookie, fingerPrints map[uint64]bool) {
 	for _, cookie := range cookies {
+		fingerPrints[sessionFingerprint(cookie.Name, cookie.Value)] = true
+	}
+}
+
+func cookieNames(cookies []*http.Cookie) []string {
+	names := make([]string, 0, len(cookies))
+	for _, cookie := range cookies {
+		names = append(names, cookie.Name)
+	}
+	return names
+}
+
+// Reads consecutive HTTP messages from the data of one flow item,
+// keeping track of how much of the data was consumed
+type httpItemReader struct {
+	data   []byte
+	source *bytes.Reader
+	*bufio.Reader
+}
+
+func newHttpItemReader(data []byte) *httpItemReader {
+	source := bytes.NewReader(data)
+	return &httpItemReader{data, source, bufio.NewReader(source)}
+}
+
+// Offset of the first byte not yet read by a parser
+func (r *httpItemReader) Offset() int {
+	return len(r.data) - r.source.Len() - r.Buffered()
+}
+
+// Request waiting for its response
+type httpPending struct {
+	index   int
+	request *http.Request
+	end     httpOffset
+}
 
-		// Prevent exploitation by encoding :pray:, who cares about collisions
-		checksum := crc32.Checksum([]byte(url.QueryEscape(cookie.Name)), crc32.IEEETable)
-		checksum = crc32.Update(checksum, crc32.IEEETable, []byte("="))
-		checksum = crc32.Update(checksum, crc32.IEEETable, []byte(url.QueryEscape(cookie.Value)))
-		fingerPrints[checksum] = true
+// Position in the data of a flow item, both in the rebuilt and in the original data,
+// since we only know which one is kept once the whole item was parsed
+type httpOffset struct {
+	item     int
+	rebuilt  int
+	original int
+}
+
+func (o httpOffset) resolve(itemRebuilt []bool) int {
+	if o.item < len(itemRebuilt) && itemRebuilt[o.item] {
+		return o.rebuilt
 	}
+	return o.original
+}
+
+// Switch from HTTP/1 to another protocol, from where on the data of both directions
+// belongs to the new protocol
+type httpUpgrade struct {
+	// "websocket" or "h2c"
+	protocol string
+	client   httpOffset
+	server   httpOffset
+	// Negotiated websocket compression
+	deflate websocketDeflate
 }
 
 // Parse and simplify every item in the flow. Items that were not successfuly
 // parsed are left as-is.
 //
+// Every item may contain multiple messages (keep-alive, pipelining). Requests
+// and responses are paired in order and summarized in flowEntry.Http.
+//
 // If we manage to simplify a flow, the new data is placed in flowEntry.data
 func ParseHttpFlow(g_db *db.Database, flow *db.FlowEntry) {
 	// Use a set to get rid of duplicates
-	fingerprintsSet := make(map[uint32]bool)
+	fingerprintsSet := make(map[uint64]bool)
+	exchanges := []db.FlowHttpExchange{}
+	pending := []httpPending{}
+	// Set once the connection switched protocols, nothing after that is HTTP/1
+	var upgrade *httpUpgrade
+	itemRebuilt := make([]bool, len(flow.Flow))
+	kind := flowDataKind(flow)
 
 	for i := range flow.Flow {
 		flowItem := &flow.Flow[i]
-		// Run only on raw representation
-		if flowItem.Kind != "raw" {
+		// Run only on raw representation, or its plaintext
+		if flowItem.Kind != kind || upgrade != nil {
 			continue
 		}
 
-		// TODO; rethink the flowItem format to make this less clunky
-		reader := bufio.NewReader(bytes.NewReader(flowItem.Data))
+		reader := newHttpItemReader(flowItem.Data)
+		// The item is rebuilt from the original bytes of every message,
+		// or its replacement if we managed to decode it
+		var rebuilt bytes.Buffer
+		parsed, replaced := 0, false
+		// End of the last message in rebuilt, parsers that fail may have read past it
+		consumed := 0
 
-		if flowItem.From == "c" {
-			// HTTP Request
-			req, err := http.ReadRequest(reader)
-			if err != nil || req == nil {
-				continue
-			}
+		for {
+			start := reader.Offset()
 
-			if !contains(flow.Tags, "http") {
-				flow.Tags = append(flow.Tags, "http")
-			}
+			if flowItem.From == "c" {
+				// HTTP/2 with prior knowledge, the server answers in its next item
+				if bytes.HasPrefix(flowItem.Data[start:], []byte(http2Preface)) {
+					upgrade = &httpUpgrade{
+						protocol: "h2c",
+						client:   httpOffset{i, rebuilt.Len(), start},
+						server:   httpOffset{i + 1, 0, 0},
+					}
+					break
+				}
 
-			if *http_session_tracking {
-				// Parse cookie and grab fingerprints
-				AddFingerprints(req.Cookies(), fingerprintsSet)
-			}
+				// HTTP Request
+				req, err := http.ReadRequest(reader.Reader)
+				if err != nil || req == nil {
+					break
+				}
 
-			//TODO; replace the HTTP data.
-			// Remember to use a `LimitReader` when implementing this to prevent
-			// decompressions bombs / DOS!
-		} else if flowItem.From == "s" {
-			// Parse HTTP Response
-			res, err := http.ReadResponse(reader, nil)
-			if err != nil || res == nil {
-				continue
-			}
+				// Consume the body, so we end up at the start of the next request
+				body, err := io.ReadAll(req.Body)
+				if err != nil {
+					break
+				}
 
-			if !contains(flow.Tags, "http") {
-				flow.Tags = append(flow.Tags, "http")
-			}
+				index := len(exchanges)
+				exchanges = append(exchanges, db.FlowHttpExchange{
+					Method:    req.Method,
+					Host:      req.Host,
+					Path:      req.URL.Path,
+					Query:     req.URL.Query(),
+					UserAgent: req.UserAgent(),
+					Cookies:   cookieNames(req.Cookies()),
+				})
 
-			if *http_session_tracking {
-				// Parse cookie and grab fingerprints
-				AddFingerprints(res.Cookies(), fingerprintsSet)
-			}
+				replacement, body := replaceRequestBody(req, body)
+				if *http_session_tracking {
+					// Grab fingerprints from cookies and the other configured session keys
+					sessionKeys.FromRequest(req, body, fingerprintsSet)
+				}
 
-			// Substitute body
-			encoding := res.Header["Content-Encoding"]
-			if encoding == nil || len(encoding) == 0 {
-				// If we don't find an encoding header, it is either not valid,
-				// or already in plain text. In any case, we don't have to edit anything.
-				continue
-			}
+				if replacement != nil {
+					rebuilt.Write(replacement)
+					replaced = true
+				} else {
+					rebuilt.Write(flowItem.Data[start:reader.Offset()])
+				}
+				consumed = reader.Offset()
 
-			var newReader io.Reader
-			if err != nil {
-				// Failed to fully read the body. Bail out here
-				continue
-			}
+				pending = append(pending, httpPending{index, req, httpOffset{i, rebuilt.Len(), reader.Offset()}})
+			} else if flowItem.From == "s" {
+				// Parse HTTP Response, the request is needed to know whether there is a body (HEAD)
+				var req *http.Request
+				if len(pending) != 0 {
+					req = pending[0].request
+				}
 
-			switch encoding[0] {
-			case "gzip":
-				newReader, err = handleGzip(res.Body)
-				break
-			case "br":
-				newReader, err = handleBrotili(res.Body)
-				break
-			case "deflate":
-				//TODO; verify this is correct
-				newReader, err = handleGzip(res.Body)
-				break
-			default:
-				// Skipped, unknown or identity encoding
-				continue
-			}
+				res, err := http.ReadResponse(reader.Reader, req)
+				if err != nil || res == nil {
+					break
+				}
 
-			// Replace the reader to allow for in-place decompression
-			if err == nil && newReader != nil {
-				// Limit the reader to prevent potential decompression bombs
-				res.Body = io.NopCloser(io.LimitReader(newReader, int64(*maxFlowItemSize * 1024 * 1024)))
-				// Delete the content-encoding header as we've basically skipped its purpose (otherwise, pkappa converters will have issues as they think it's still encoded).
-				// In case of multiple values there, this logic wouldn't be hit anyway
-				res.Header.Del("Content-Encoding")
-				// invalidate the content length, since decompressing the body will change its value.
-				res.ContentLength = -1
-				replacement, err := httputil.DumpResponse(res, true)
+				if *http_session_tracking {
+					// Grab fingerprints from cookies and the other configured session keys
+					sessionKeys.FromResponse(res, fingerprintsSet)
+				}
+
+				// Reading the body also removes the chunked transfer-encoding
+				body, err := io.ReadAll(res.Body)
 				if err != nil {
-					// HTTPUtil failed us, continue without replacing anything.
+					// Failed to fully read the body. Bail out here
+					break
+				}
+
+				replacement, length := replaceResponseBody(res, body)
+				if replacement != nil {
+					rebuilt.Write(replacement)
+					replaced = true
+				} else {
+					rebuilt.Write(flowItem.Data[start:reader.Offset()])
+				}
+				consumed = reader.Offset()
+
+				// Informational responses are followed by the actual response
+				if res.StatusCode >= 100 && res.StatusCode < 200 && res.StatusCode != http.StatusSwitchingProtocols {
+					parsed++
 					continue
 				}
-				// This can exceed the mongo document limit, so we need to make sure
-				// the replacement will fit
-				new_size := flow.Size + (len(replacement) - len(flowItem.Data))
-				if new_size <= *maxFlowItemSize * 1024 * 1024 {
-					flowItem.Data = replacement
-					flow.Size = new_size
+
+				protocol := strings.ToLower(res.Header.Get("Upgrade"))
+				if res.StatusCode == http.StatusSwitchingProtocols && (protocol == "websocket" || protocol == "h2c") {
+					upgrade = &httpUpgrade{
+						protocol: protocol,
+						// Without the request, the client data starts with its next item
+						client:   httpOffset{i + 1, 0, 0},
+						server:   httpOffset{i, rebuilt.Len(), reader.Offset()},
+						deflate:  parseWebsocketDeflate(res.Header.Get("Sec-WebSocket-Extensions")),
+					}
+					if len(pending) != 0 {
+						upgrade.client = pending[0].end
+					}
 				}
+
+				exchange := db.FlowHttpExchange{}
+				index := len(exchanges)
+				if len(pending) != 0 {
+					index = pending[0].index
+					exchange = exchanges[index]
+					pending = pending[1:]
+				} else {
+					exchanges = append(exchanges, exchange)
+				}
+
+				exchange.Status = res.StatusCode
+				exchange.SetCookies = cookieNames(res.Cookies())
+				exchange.ContentType = res.Header.Get("Content-Type")
+				exchange.Length = length
+				exchanges[index] = exchange
+
+				// The rest of the item belongs to the new protocol
+				if upgrade != nil {
+					parsed++
+					break
+				}
+			} else {
+				break
 			}
+
+			parsed++
+		}
+
+		if parsed == 0 {
+			continue
+		}
+
+		if !contains(flow.Tags, "http") {
+			flow.Tags = append(flow.Tags, "http")
+		}
+
+		if !replaced {
+			continue
+		}
+
+		// Whatever we could not parse stays as it is
+		rebuilt.Write(flowItem.Data[consumed:])
+
+		// This can exceed the mongo document limit, so we need to make sure
+		// the replacement will fit
+		new_size := flow.Size + (rebuilt.Len() - len(flowItem.Data))
+		if new_size <= *maxFlowItemSize * 1024 * 1024 {
+			flowItem.Data = rebuilt.Bytes()
+			// Packet boundaries don't match the decoded data anymore
+			flowItem.Meta.Segments = nil
+			flow.Size = new_size
+			itemRebuilt[i] = true
+		}
+	}
+
+	flow.Http = exchanges
+
+	if upgrade != nil {
+		switch upgrade.protocol {
+		case "websocket":
+			ParseWebsocketFlow(flow, upgrade, itemRebuilt)
+		case "h2c":
+			ParseHttp2Flow(flow, upgrade, itemRebuilt)
 		}
 	}
 
 	if *http_session_tracking {
+		// Session keys of non-HTTP protocols
+		sessionKeys.FromFlow(flow, fingerprintsSet)
+
 		// Use maps.Keys(fingerprintsSet) in the future
-		flow.Fingerprints = make([]uint32, 0, len(fingerprintsSet))
+		flow.Fingerprints = make([]uint64, 0, len(fingerprintsSet))
 		for k := range fingerprintsSet {
 			flow.Fingerprints = append(flow.Fingerprints, k)
 		}
 	}
 }
 
-func handleGzip(r io.Reader) (io.Reader, error) {
-	return gzip.NewReader(r)
+// Decode the body of a request. Returns the replacement message, or nil if
+// nothing had to be replaced, and the (decoded) body.
+func replaceRequestBody(req *http.Request, body []byte) ([]byte, []byte) {
+	decoded, ok := decodeBody(req.Header, body)
+	if !ok {
+		return nil, body
+	}
+
+	req.Header.Del("Content-Encoding")
+	// Unlike responses, requests are dumped with their headers as they are
+	req.Header.Set("Content-Length", strconv.Itoa(len(decoded)))
+	req.TransferEncoding = nil
+	req.ContentLength = int64(len(decoded))
+	req.Body = io.NopCloser(bytes.NewReader(decoded))
+
+	replacement, err := httputil.DumpRequest(req, true)
+	if err != nil {
+		return nil, decoded
+	}
+
+	return replacement, decoded
+}
+
+// Decode the body of a response. Returns the replacement message, or nil if
+// nothing had to be replaced, and the length of the (decoded) body.
+func replaceResponseBody(res *http.Response, body []byte) ([]byte, int64) {
+	decoded, ok := decodeBody(res.Header, body)
+	if !ok {
+		return nil, int64(len(body))
+	}
+
+	// Delete the content-encoding header as we've basically skipped its purpose (otherwise, pkappa converters will have issues as they think it's still encoded).
+	res.Header.Del("Content-Encoding")
+	// The body is written as a whole, so the length changes and chunking is gone
+	res.TransferEncoding = nil
+	res.ContentLength = int64(len(decoded))
+	res.Body = io.NopCloser(bytes.NewReader(decoded))
+
+	replacement, err := httputil.DumpResponse(res, true)
+	if err != nil {
+		// HTTPUtil failed us, continue without replacing anything.
+		return nil, int64(len(body))
+	}
+
+	return replacement, int64(len(decoded))
+}
+
+// Undo all content encodings of a body, in the reverse order they were applied.
+// Returns false if there was nothing to decode or an encoding is unknown or broken.
+func decodeBody(header http.Header, body []byte) ([]byte, bool) {
+	encodings := []string{}
+	for _, value := range header.Values("Content-Encoding") {
+		for _, encoding := range strings.Split(value, ",") {
+			encoding = strings.ToLower(strings.TrimSpace(encoding))
+			if encoding != "" && encoding != "identity" {
+				encodings = append(encodings, encoding)
+			}
+		}
+	}
+
+	if len(encodings) == 0 {
+		// If we don't find an encoding header, it is either not valid,
+		// or already in plain text. In any case, we don't have to edit anything.
+		return nil, false
+	}
+
+	// Limit the output to prevent potential decompression bombs
+	limit := int64(*maxFlowItemSize * 1024 * 1024)
+
+	for i := len(encodings) - 1; i >= 0; i-- {
+		var decoded []byte
+		var err error
+
+		switch encodings[i] {
+		case "gzip", "x-gzip":
+			decoded, err = handleGzip(body, limit)
+		case "br":
+			decoded, err = handleBrotili(body, limit)
+		case "deflate":
+			decoded, err = handleDeflate(body, limit)
+		case "zstd":
+			decoded, err = handleZstd(body, limit)
+		default:
+			// Skipped, unknown encoding
+			return nil, false
+		}
+
+		if err != nil {
+			return nil, false
+		}
+		body = decoded
+	}
+
+	return body, true
+}
+
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	return io.ReadAll(io.LimitReader(r, limit))
+}
+
+func handleGzip(body []byte, limit int64) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	return readLimited(reader, limit)
+}
+
+func handleBrotili(body []byte, limit int64) ([]byte, error) {
+	reader := brotli.NewReader(bytes.NewReader(body))
+	return readLimited(reader, limit)
 }
 
-func handleBrotili(r io.Reader) (io.Reader, error) {
-	reader := brotli.NewReader(r)
-	return reader, nil
+// "deflate" is supposed to be zlib wrapped, but plenty of servers send raw deflate
+func handleDeflate(body []byte, limit int64) ([]byte, error) {
+	if reader, err := zlib.NewReader(bytes.NewReader(body)); err == nil {
+		if decoded, err := readLimited(reader, limit); err == nil {
+			return decoded, nil
+		}
+	}
+
+	reader := flate.NewReader(bytes.NewReader(body))
+	defer reader.Close()
+	return readLimited(reader, limit)
+}
+
+func handleZstd(body []byte, limit int64) ([]byte, error) {
+	reader, err := zstd.NewReader(bytes.NewReader(body),
+		zstd.WithDecoderConcurrency(1),
+		zstd.WithDecoderMaxMemory(uint64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return readLimited(reader, limit)
 }
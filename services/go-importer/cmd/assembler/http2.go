@@ -0,0 +1,489 @@
+package main
+
+import (
+	"go-importer/internal/pkg/db"
+
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2/hpack"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// First bytes a client sends on an HTTP/2 connection
+const http2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+const (
+	http2FrameData         = 0x0
+	http2FrameHeaders      = 0x1
+	http2FramePushPromise  = 0x5
+	http2FrameContinuation = 0x9
+
+	http2FlagEndStream  = 0x1
+	http2FlagEndHeaders = 0x4
+	http2FlagPadded     = 0x8
+	http2FlagPriority   = 0x20
+)
+
+// One side of an HTTP/2 stream
+type http2Message struct {
+	// Flow item in which the message started, used to order the messages of both directions
+	item     int
+	time     time.Time
+	headers  []hpack.HeaderField
+	trailers []hpack.HeaderField
+	data     []byte
+}
+
+func (message *http2Message) header(name string) string {
+	for _, field := range message.headers {
+		if field.Name == name {
+			return field.Value
+		}
+	}
+	return ""
+}
+
+type http2Stream struct {
+	id       uint32
+	request  *http2Message
+	response *http2Message
+}
+
+// Reassembles the frames of one direction of an HTTP/2 connection
+type http2Parser struct {
+	from    string
+	decoder *hpack.Decoder
+	streams map[uint32]*http2Stream
+	buffer  []byte
+
+	// Header block spread over HEADERS / PUSH_PROMISE and CONTINUATION frames
+	block       []byte
+	blockStream uint32
+	blockPush   bool
+}
+
+func newHttp2Parser(from string, streams map[uint32]*http2Stream) *http2Parser {
+	decoder := hpack.NewDecoder(4096, nil)
+	// We never saw what the peer allowed, so accept any table size
+	decoder.SetAllowedMaxDynamicTableSize(1 << 20)
+	return &http2Parser{from: from, decoder: decoder, streams: streams}
+}
+
+func (parser *http2Parser) message(id uint32, item int, itemTime time.Time, request bool) *http2Message {
+	stream, ok := parser.streams[id]
+	if !ok {
+		stream = &http2Stream{id: id}
+		parser.streams[id] = stream
+	}
+
+	message := &stream.response
+	if request {
+		message = &stream.request
+	}
+	if *message == nil {
+		*message = &http2Message{item: item, time: itemTime}
+	}
+	return *message
+}
+
+// Feed the data of the next flow item of this direction
+func (parser *http2Parser) Feed(item int, itemTime time.Time, data []byte) error {
+	parser.buffer = append(parser.buffer, data...)
+
+	for len(parser.buffer) >= 9 {
+		length := int(parser.buffer[0])<<16 | int(parser.buffer[1])<<8 | int(parser.buffer[2])
+		if len(parser.buffer) < 9+length {
+			return nil
+		}
+
+		frameType := parser.buffer[3]
+		flags := parser.buffer[4]
+		id := binary.BigEndian.Uint32(parser.buffer[5:9]) & 0x7fffffff
+		payload := parser.buffer[9 : 9+length]
+		parser.buffer = parser.buffer[9+length:]
+
+		if err := parser.frame(item, itemTime, frameType, flags, id, payload); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (parser *http2Parser) frame(item int, itemTime time.Time, frameType byte, flags byte, id uint32, payload []byte) error {
+	if parser.block != nil && frameType != http2FrameContinuation {
+		return errors.New("header block interrupted")
+	}
+
+	switch frameType {
+	case http2FrameData:
+		payload, err := http2Unpad(flags, payload)
+		if err != nil {
+			return err
+		}
+
+		message := parser.message(id, item, itemTime, parser.from == "c")
+		if len(message.data)+len(payload) > *maxFlowItemSize*1024*1024 {
+			return errors.New("http2 message too large")
+		}
+		message.data = append(message.data, payload...)
+	case http2FrameHeaders, http2FramePushPromise:
+		payload, err := http2Unpad(flags, payload)
+		if err != nil {
+			return err
+		}
+
+		parser.blockStream = id
+		parser.blockPush = frameType == http2FramePushPromise
+		if parser.blockPush {
+			// Promised requests are sent by the server, on the stream they promise
+			if len(payload) < 4 {
+				return errors.New("push promise too short")
+			}
+			parser.blockStream = binary.BigEndian.Uint32(payload) & 0x7fffffff
+			payload = payload[4:]
+		} else if flags&http2FlagPriority != 0 {
+			if len(payload) < 5 {
+				return errors.New("headers too short")
+			}
+			payload = payload[5:]
+		}
+
+		// Make sure the block is never nil while it is being assembled
+		parser.block = append([]byte{}, payload...)
+		if flags&http2FlagEndHeaders != 0 {
+			return parser.endBlock(item, itemTime)
+		}
+	case http2FrameContinuation:
+		if parser.block == nil {
+			return errors.New("continuation without headers")
+		}
+
+		parser.block = append(parser.block, payload...)
+		if flags&http2FlagEndHeaders != 0 {
+			return parser.endBlock(item, itemTime)
+		}
+	}
+
+	// Everything else is connection management, nothing to show there
+	return nil
+}
+
+// Decode a complete header block, this has to happen for every block to keep the HPACK table in sync
+func (parser *http2Parser) endBlock(item int, itemTime time.Time) error {
+	fields, err := parser.decoder.DecodeFull(parser.block)
+	parser.block = nil
+	if err != nil {
+		return err
+	}
+
+	request := parser.from == "c" || parser.blockPush
+	// Informational responses like 100 Continue come before the actual response
+	if !request && http2Informational(fields) {
+		return nil
+	}
+	message := parser.message(parser.blockStream, item, itemTime, request)
+	if message.headers == nil {
+		message.headers = fields
+	} else {
+		message.trailers = append(message.trailers, fields...)
+	}
+	return nil
+}
+
+func http2Informational(fields []hpack.HeaderField) bool {
+	for _, field := range fields {
+		if field.Name == ":status" {
+			return len(field.Value) == 3 && field.Value[0] == '1'
+		}
+	}
+	return false
+}
+
+func http2Unpad(flags byte, payload []byte) ([]byte, error) {
+	if flags&http2FlagPadded == 0 {
+		return payload, nil
+	}
+
+	if len(payload) < 1 || int(payload[0]) >= len(payload) {
+		return nil, errors.New("invalid padding")
+	}
+	return payload[1 : len(payload)-int(payload[0])], nil
+}
+
+// Turn the messages of all streams into readable request / response items and HTTP exchanges
+// Headers are written like HTTP/1, with the pseudo headers in the first line.
+func ParseHttp2Flow(flow *db.FlowEntry, upgrade *httpUpgrade, itemRebuilt []bool) {
+	streams := make(map[uint32]*http2Stream)
+	starts := map[string]httpOffset{"c": upgrade.client, "s": upgrade.server}
+	kind := flowDataKind(flow)
+
+	for from, start := range starts {
+		parser := newHttp2Parser(from, streams)
+
+		for i := start.item; i < len(flow.Flow); i++ {
+			item := flow.Flow[i]
+			if item.Kind != kind || item.From != from {
+				continue
+			}
+
+			// There is no way to find the next frame after missing data
+			if item.Meta.Gap != nil {
+				break
+			}
+
+			data := item.Data
+			if i == start.item {
+				data = data[start.resolve(itemRebuilt):]
+			}
+			// The client preface follows the upgrade request as well
+			if from == "c" && parser.buffer == nil {
+				data = bytes.TrimPrefix(data, []byte(http2Preface))
+			}
+
+			if err := parser.Feed(i, item.Time, data); err != nil {
+				break
+			}
+		}
+	}
+
+	ids := make([]uint32, 0, len(streams))
+	for id := range streams {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	type http2Item struct {
+		item int
+		db.FlowItem
+	}
+	items := []http2Item{}
+	grpc := false
+
+	for _, id := range ids {
+		stream := streams[id]
+		exchange := db.FlowHttpExchange{}
+		path := ""
+
+		if request := stream.request; request != nil && request.headers != nil {
+			rawPath := request.header(":path")
+			parsed, _ := url.ParseRequestURI(rawPath)
+			if parsed != nil {
+				path = parsed.Path
+				exchange.Path = parsed.Path
+				exchange.Query = parsed.Query()
+			}
+			exchange.Method = request.header(":method")
+			exchange.Host = request.header(":authority")
+			exchange.UserAgent = request.header("user-agent")
+
+			head := fmt.Sprintf("%s %s HTTP/2\r\n", exchange.Method, rawPath)
+			items = append(items, http2Item{request.item, db.FlowItem{
+				Kind: "http2",
+				From: "c",
+				Data: request.render(head, path, true),
+				Time: request.time,
+			}})
+		}
+
+		if response := stream.response; response != nil && response.headers != nil {
+			exchange.Status, _ = strconv.Atoi(response.header(":status"))
+			exchange.ContentType = response.header("content-type")
+			exchange.Length = int64(len(response.data))
+
+			head := fmt.Sprintf("HTTP/2 %s\r\n", response.header(":status"))
+			items = append(items, http2Item{response.item, db.FlowItem{
+				Kind: "http2",
+				From: "s",
+				Data: response.render(head, path, false),
+				Time: response.time,
+			}})
+		}
+
+		if exchange.Method != "" || exchange.Status != 0 {
+			flow.Http = append(flow.Http, exchange)
+		}
+		if strings.HasPrefix(exchange.ContentType, "application/grpc") {
+			grpc = true
+		}
+	}
+
+	if len(items) == 0 {
+		return
+	}
+
+	// Flow items alternate between the directions, so this keeps the conversation in order
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].item < items[j].item
+	})
+
+	flowItems := make([]db.FlowItem, len(items))
+	for i, item := range items {
+		flowItems[i] = item.FlowItem
+	}
+	appendFlowItems(flow, flowItems)
+
+	if !contains(flow.Tags, "http2") {
+		flow.Tags = append(flow.Tags, "http2")
+	}
+	if grpc && !contains(flow.Tags, "grpc") {
+		flow.Tags = append(flow.Tags, "grpc")
+	}
+}
+
+// Write a message like HTTP/1, with decoded body and the trailers at the end
+func (message *http2Message) render(head string, path string, request bool) []byte {
+	var out bytes.Buffer
+	out.WriteString(head)
+
+	header := http.Header{}
+	for _, field := range message.headers {
+		if strings.HasPrefix(field.Name, ":") {
+			if field.Name == ":authority" {
+				out.WriteString("host: " + field.Value + "\r\n")
+			}
+			continue
+		}
+		header.Add(field.Name, field.Value)
+		out.WriteString(field.Name + ": " + field.Value + "\r\n")
+	}
+	out.WriteString("\r\n")
+
+	body := message.data
+	if decoded, ok := decodeBody(header, body); ok {
+		body = decoded
+	}
+
+	if strings.HasPrefix(header.Get("Content-Type"), "application/grpc") {
+		body = renderGrpc(body, header.Get("Grpc-Encoding"), path, request)
+	}
+	out.Write(body)
+
+	if len(message.trailers) != 0 {
+		out.WriteString("\r\n\r\n")
+		for _, field := range message.trailers {
+			out.WriteString(field.Name + ": " + field.Value + "\r\n")
+		}
+	}
+
+	return out.Bytes()
+}
+
+/*
+ * gRPC
+ */
+
+// Protobuf descriptors used to decode gRPC messages, see -grpc-descriptors
+var grpcDescriptors *protoregistry.Files
+
+// Load a FileDescriptorSet, as written by protoc --include_imports --descriptor_set_out
+func LoadGrpcDescriptors(path string) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	set := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(raw, set); err != nil {
+		return err
+	}
+
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return err
+	}
+
+	grpcDescriptors = files
+	return nil
+}
+
+// Split the length-prefixed messages of a gRPC body, each one on its own line.
+// Messages are decoded to JSON if we have descriptors for the called method.
+func renderGrpc(body []byte, encoding string, path string, request bool) []byte {
+	var out bytes.Buffer
+
+	for len(body) >= 5 {
+		compressed := body[0] == 1
+		length := binary.BigEndian.Uint32(body[1:5])
+		if uint64(len(body)-5) < uint64(length) {
+			break
+		}
+
+		message := body[5 : 5+length]
+		body = body[5+length:]
+
+		if compressed && encoding == "gzip" {
+			if decoded, err := handleGzip(message, int64(*maxFlowItemSize*1024*1024)); err == nil {
+				message = decoded
+			}
+		}
+
+		if decoded, ok := decodeGrpcMessage(message, path, request); ok {
+			message = decoded
+		}
+
+		out.Write(message)
+		out.WriteString("\n")
+	}
+
+	// Whatever does not look like a gRPC message stays as it is
+	out.Write(body)
+	return out.Bytes()
+}
+
+func decodeGrpcMessage(message []byte, path string, request bool) ([]byte, bool) {
+	if grpcDescriptors == nil {
+		return nil, false
+	}
+
+	// Paths look like /package.Service/Method
+	service, method, ok := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	if !ok {
+		return nil, false
+	}
+
+	descriptor, err := grpcDescriptors.FindDescriptorByName(protoreflect.FullName(service))
+	if err != nil {
+		return nil, false
+	}
+	serviceDescriptor, ok := descriptor.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, false
+	}
+	methodDescriptor := serviceDescriptor.Methods().ByName(protoreflect.Name(method))
+	if methodDescriptor == nil {
+		return nil, false
+	}
+
+	messageDescriptor := methodDescriptor.Output()
+	if request {
+		messageDescriptor = methodDescriptor.Input()
+	}
+
+	decoded := dynamicpb.NewMessage(messageDescriptor)
+	if err := proto.Unmarshal(message, decoded); err != nil {
+		return nil, false
+	}
+
+	json, err := protojson.MarshalOptions{Resolver: dynamicpb.NewTypes(grpcDescriptors)}.Marshal(decoded)
+	if err != nil {
+		return nil, false
+	}
+	return json, true
+}
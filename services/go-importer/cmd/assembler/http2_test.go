@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+// Frame of an HTTP/2 connection
+func http2TestFrame(frameType byte, flags byte, id uint32, payload []byte) []byte {
+	frame := []byte{byte(len(payload) >> 16), byte(len(payload) >> 8), byte(len(payload)), frameType, flags, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(frame[5:], id)
+	return append(frame, payload...)
+}
+
+// Header block of the fields, given as name / value pairs
+func http2TestHeaders(t *testing.T, encoder *hpack.Encoder, block *bytes.Buffer, fields ...string) []byte {
+	t.Helper()
+	block.Reset()
+	for i := 0; i < len(fields); i += 2 {
+		if err := encoder.WriteField(hpack.HeaderField{Name: fields[i], Value: fields[i+1]}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return append([]byte{}, block.Bytes()...)
+}
+
+func TestHttp2SkipsInformationalResponse(t *testing.T) {
+	var block bytes.Buffer
+	encoder := hpack.NewEncoder(&block)
+
+	var data []byte
+	data = append(data, http2TestFrame(http2FrameHeaders, http2FlagEndHeaders, 1,
+		http2TestHeaders(t, encoder, &block, ":status", "100"))...)
+	data = append(data, http2TestFrame(http2FrameHeaders, http2FlagEndHeaders, 1,
+		http2TestHeaders(t, encoder, &block, ":status", "200", "content-type", "text/plain"))...)
+	data = append(data, http2TestFrame(http2FrameData, 0, 1, []byte("ok"))...)
+	data = append(data, http2TestFrame(http2FrameHeaders, http2FlagEndHeaders|http2FlagEndStream, 1,
+		http2TestHeaders(t, encoder, &block, "grpc-status", "0"))...)
+
+	streams := map[uint32]*http2Stream{}
+	parser := newHttp2Parser("s", streams)
+	if err := parser.Feed(0, time.Time{}, data); err != nil {
+		t.Fatal(err)
+	}
+
+	response := streams[1].response
+	if status := response.header(":status"); status != "200" {
+		t.Errorf("response has status %q, expected 200", status)
+	}
+	if len(response.trailers) != 1 || response.trailers[0].Name != "grpc-status" {
+		t.Errorf("unexpected trailers: %v", response.trailers)
+	}
+	if string(response.data) != "ok" {
+		t.Errorf("unexpected data: %q", response.data)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"go-importer/internal/pkg/db"
+
+	"bytes"
+	"compress/gzip"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func gzipTestBody(t *testing.T, body string) []byte {
+	t.Helper()
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write([]byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return compressed.Bytes()
+}
+
+func parseTestHttpFlow(items ...db.FlowItem) *db.FlowEntry {
+	flow := &db.FlowEntry{Flow: items}
+	for _, item := range items {
+		flow.Size += len(item.Data)
+	}
+	ParseHttpFlow(nil, flow)
+	return flow
+}
+
+func TestHttpKeepsMessageAfterDecodedResponse(t *testing.T) {
+	compressed := gzipTestBody(t, "hello world")
+	truncated := "HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\nnot all of it"
+	response := "HTTP/1.1 200 OK\r\nContent-Encoding: gzip\r\nContent-Length: " + strconv.Itoa(len(compressed)) + "\r\n\r\n" +
+		string(compressed) + truncated
+
+	flow := parseTestHttpFlow(
+		db.FlowItem{Kind: "raw", From: "c", Data: []byte("GET /a HTTP/1.1\r\nHost: a\r\n\r\nGET /b HTTP/1.1\r\nHost: a\r\n\r\n")},
+		db.FlowItem{Kind: "raw", From: "s", Data: []byte(response)},
+	)
+
+	data := string(flow.Flow[1].Data)
+	if !strings.Contains(data, "\r\n\r\nhello world") {
+		t.Errorf("first response was not decoded: %q", data)
+	}
+	if !strings.HasSuffix(data, "hello world"+truncated) {
+		t.Errorf("truncated response was not kept: %q", data)
+	}
+}
+
+func TestHttpKeepsMessageAfterDecodedRequest(t *testing.T) {
+	compressed := gzipTestBody(t, "name=value")
+	malformed := "POST /b HTTP/1.1\r\nHost a\r\n\r\n"
+	request := "POST /a HTTP/1.1\r\nHost: a\r\nContent-Encoding: gzip\r\nContent-Length: " + strconv.Itoa(len(compressed)) + "\r\n\r\n" +
+		string(compressed) + malformed
+
+	flow := parseTestHttpFlow(db.FlowItem{Kind: "raw", From: "c", Data: []byte(request)})
+
+	data := string(flow.Flow[0].Data)
+	if !strings.HasSuffix(data, "name=value"+malformed) {
+		t.Errorf("malformed request was not kept: %q", data)
+	}
+	if len(flow.Http) != 1 || flow.Http[0].Path != "/a" {
+		t.Errorf("unexpected exchanges: %+v", flow.Http)
+	}
+}
+
+func TestHttpReadsDecryptedTls(t *testing.T) {
+	flow := &db.FlowEntry{
+		Tags: []string{"tls", "tls-decrypted"},
+		Flow: []db.FlowItem{
+			{Kind: "raw", From: "c", Data: []byte{0x17, 0x03, 0x03, 0x00, 0x01, 0x00}},
+			{Kind: "raw", From: "s", Data: []byte{0x17, 0x03, 0x03, 0x00, 0x01, 0x00}},
+			{Kind: "tls", From: "c", Data: []byte("GET /secret HTTP/1.1\r\nHost: a\r\n\r\n")},
+			{Kind: "tls", From: "s", Data: []byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")},
+		},
+	}
+	ParseHttpFlow(nil, flow)
+
+	if len(flow.Http) != 1 || flow.Http[0].Path != "/secret" {
+		t.Errorf("plaintext was not parsed: %+v", flow.Http)
+	}
+}
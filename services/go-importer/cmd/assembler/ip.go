@@ -0,0 +1,296 @@
+package main
+
+import (
+	"go-importer/internal/pkg/db"
+
+	"encoding/binary"
+	"net/netip"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Assembles everything that is neither TCP nor UDP: ICMP / ICMPv6 echo sessions,
+// SCTP associations and a catch-all flow per address pair for any other IP protocol.
+// Like UDP, these flows are only completed once they time out (see -flush-after-udp).
+type IpAssembler struct {
+	Streams map[IpStreamIdentifier]*IpStream
+}
+
+func NewIpAssembler() IpAssembler {
+	return IpAssembler{
+		Streams: map[IpStreamIdentifier]*IpStream{},
+	}
+}
+
+type IpStreamIdentifier struct {
+	Protocol      layers.IPProtocol
+	EndpointLower gopacket.Endpoint
+	IdLower       uint16
+	EndpointUpper gopacket.Endpoint
+	IdUpper       uint16
+}
+
+// One packet, reduced to what the stream needs
+type ipSegment struct {
+	protocol layers.IPProtocol
+	tag      string
+	// Ports for SCTP, echo identifier for ICMP
+	idSrc uint16
+	idDst uint16
+	// Set when the packet itself tells us its direction (e.g. echo request / reply)
+	from     string
+	payloads [][]byte
+}
+
+func (assembler *IpAssembler) Assemble(network gopacket.NetworkLayer, payload []gopacket.Layer, captureInfo *gopacket.CaptureInfo, source string, tunnel []db.FlowTunnel) *IpStream {
+	segment, ok := parseIpSegment(network, payload)
+	if !ok {
+		return nil
+	}
+
+	flow := network.NetworkFlow()
+	endpointSrc, endpointDst := flow.Endpoints()
+
+	var id IpStreamIdentifier
+	if endpointDst.LessThan(endpointSrc) || (endpointDst == endpointSrc && segment.idDst < segment.idSrc) {
+		id = IpStreamIdentifier{segment.protocol, endpointDst, segment.idDst, endpointSrc, segment.idSrc}
+	} else {
+		id = IpStreamIdentifier{segment.protocol, endpointSrc, segment.idSrc, endpointDst, segment.idDst}
+	}
+
+	stream, ok := assembler.Streams[id]
+	if !ok {
+		// Replies seen first (e.g. the request was not captured) still belong to the server
+		if segment.from == "s" {
+			flow = flow.Reverse()
+			segment.idSrc, segment.idDst = segment.idDst, segment.idSrc
+		}
+
+		stream = &IpStream{
+			Identifier: id,
+			Flow:       flow,
+			PortSrc:    segment.idSrc,
+			PortDst:    segment.idDst,
+			Tag:        segment.tag,
+			Source:     source,
+			Tunnel:     tunnel,
+			Limiter:    NewFlowLimiter(captureInfo.Timestamp, flow, segment.idSrc, segment.idDst),
+		}
+
+		assembler.Streams[id] = stream
+	}
+
+	stream.ProcessSegment(flow, segment, captureInfo)
+	return stream
+}
+
+// Parse the layers following the network layer of a packet
+func parseIpSegment(network gopacket.NetworkLayer, payload []gopacket.Layer) (ipSegment, bool) {
+	if icmp, ok := findLayer(payload, layers.LayerTypeICMPv4).(*layers.ICMPv4); ok {
+		segment := ipSegment{protocol: layers.IPProtocolICMPv4, tag: "icmp"}
+		switch icmp.TypeCode.Type() {
+		case layers.ICMPv4TypeEchoRequest:
+			segment.idSrc, segment.idDst, segment.from = icmp.Id, icmp.Id, "c"
+		case layers.ICMPv4TypeEchoReply:
+			segment.idSrc, segment.idDst, segment.from = icmp.Id, icmp.Id, "s"
+		}
+		segment.payloads = [][]byte{icmp.Payload}
+		return segment, true
+	}
+
+	if icmp, ok := findLayer(payload, layers.LayerTypeICMPv6).(*layers.ICMPv6); ok {
+		segment := ipSegment{protocol: layers.IPProtocolICMPv6, tag: "icmpv6"}
+		switch icmp.TypeCode.Type() {
+		case layers.ICMPv6TypeRouterSolicitation, layers.ICMPv6TypeRouterAdvertisement,
+			layers.ICMPv6TypeNeighborSolicitation, layers.ICMPv6TypeNeighborAdvertisement,
+			layers.ICMPv6TypeRedirect:
+			// Neighbor discovery is part of the network plumbing, not of the game
+			return segment, false
+		case layers.ICMPv6TypeEchoRequest, layers.ICMPv6TypeEchoReply:
+			echo, ok := findLayer(payload, layers.LayerTypeICMPv6Echo).(*layers.ICMPv6Echo)
+			if !ok {
+				return segment, false
+			}
+			segment.idSrc, segment.idDst = echo.Identifier, echo.Identifier
+			segment.from = "c"
+			if icmp.TypeCode.Type() == layers.ICMPv6TypeEchoReply {
+				segment.from = "s"
+			}
+			segment.payloads = [][]byte{echo.Payload}
+		default:
+			segment.payloads = [][]byte{icmp.Payload}
+		}
+		return segment, true
+	}
+
+	if sctp, ok := findLayer(payload, layers.LayerTypeSCTP).(*layers.SCTP); ok {
+		segment := ipSegment{
+			protocol: layers.IPProtocolSCTP,
+			tag:      "sctp",
+			idSrc:    uint16(sctp.SrcPort),
+			idDst:    uint16(sctp.DstPort),
+			payloads: sctpUserData(sctp.Payload),
+		}
+		return segment, true
+	}
+
+	// Anything else, keyed only on the addresses and the protocol number
+	var protocol layers.IPProtocol
+	switch ip := network.(type) {
+	case *layers.IPv4:
+		protocol = ip.Protocol
+	case *layers.IPv6:
+		protocol = ip.NextHeader
+	default:
+		return ipSegment{}, false
+	}
+
+	segment := ipSegment{
+		protocol: protocol,
+		tag:      "ip",
+		payloads: [][]byte{network.LayerPayload()},
+	}
+	return segment, true
+}
+
+// Extract the user data of all DATA chunks in an SCTP packet. gopacket only decodes
+// the first chunk as SCTPData, so we walk the chunks ourselves.
+func sctpUserData(chunks []byte) [][]byte {
+	var payloads [][]byte
+	for len(chunks) >= 4 {
+		chunkType := layers.SCTPChunkType(chunks[0])
+		length := int(binary.BigEndian.Uint16(chunks[2:4]))
+		if length < 4 || length > len(chunks) {
+			break
+		}
+
+		if chunkType == layers.SCTPChunkTypeData && length >= 16 {
+			payloads = append(payloads, chunks[16:length])
+		}
+
+		// Chunks are padded to 4 bytes
+		padded := (length + 3) &^ 3
+		if padded > len(chunks) {
+			break
+		}
+		chunks = chunks[padded:]
+	}
+	return payloads
+}
+
+func (assembler *IpAssembler) CompleteOlderThan(threshold time.Time) []*db.FlowEntry {
+	flows := make([]*db.FlowEntry, 0)
+
+	for id, stream := range assembler.Streams {
+		if stream.LastSeen.Unix() < threshold.Unix() {
+			flow := stream.CompleteReassembly()
+			if flow != nil {
+				flows = append(flows, flow)
+			}
+			delete(assembler.Streams, id)
+		}
+	}
+
+	return flows
+}
+
+type IpStream struct {
+	Identifier  IpStreamIdentifier
+	Flow        gopacket.Flow
+	PacketCount uint
+	PacketSize  uint
+	SizeClient  uint
+	SizeServer  uint
+	Limiter     FlowLimiter
+	Items       []db.FlowItem
+	PortSrc     uint16
+	PortDst     uint16
+	Tag         string
+	Source      string
+	Tunnel      []db.FlowTunnel
+	LastSeen    time.Time
+}
+
+func (stream *IpStream) ProcessSegment(flow gopacket.Flow, segment ipSegment, captureInfo *gopacket.CaptureInfo) {
+	from := segment.from
+	if from == "" {
+		from = "s"
+		if flow.Src() == stream.Flow.Src() && segment.idSrc == stream.PortSrc {
+			from = "c"
+		}
+	}
+
+	stream.LastSeen = captureInfo.Timestamp
+	stream.PacketCount += 1
+
+	offset := &stream.SizeServer
+	if from == "c" {
+		offset = &stream.SizeClient
+	}
+
+	for _, payload := range segment.payloads {
+		if len(payload) == 0 {
+			continue
+		}
+
+		stream.PacketSize += uint(len(payload))
+
+		// We have to make sure to stay under the document limit
+		data := stream.Limiter.Fit(from, int(*offset), payload)
+		*offset += uint(len(payload))
+
+		stream.Items = append(stream.Items, db.FlowItem{
+			Kind: "raw",
+			From: from,
+			Data: data,
+			Time: captureInfo.Timestamp,
+		})
+	}
+}
+
+func (stream *IpStream) CompleteReassembly() *db.FlowEntry {
+	if len(stream.Items) == 0 {
+		return nil
+	}
+
+	src, dst := stream.Flow.Endpoints()
+	ip_src, _ := netip.ParseAddr(src.String())
+	ip_dst, _ := netip.ParseAddr(dst.String())
+
+	timeStart := stream.Items[0].Time
+	timeEnd := stream.Items[0].Time
+	for _, item := range stream.Items {
+		if timeEnd.Before(item.Time) {
+			timeEnd = item.Time
+		}
+	}
+
+	tags := []string{stream.Tag}
+	if stream.Limiter.Truncated {
+		tags = append(tags, "truncated")
+	}
+
+	return &db.FlowEntry{
+		Src_port:    stream.PortSrc,
+		Dst_port:    stream.PortDst,
+		Src_ip:      ip_src,
+		Dst_ip:      ip_dst,
+		Time:        timeStart,
+		Duration:    timeEnd.Sub(timeStart),
+		Num_packets: int(stream.PacketCount),
+		Parent_id:   nil,
+		Child_id:    nil,
+		Tags:        tags,
+		Filename:    stream.Source,
+		Flow:        stream.Items,
+		Size:        int(stream.PacketSize),
+		Size_Client: int64(stream.SizeClient),
+		Size_Server: int64(stream.SizeServer),
+		Overflow:    stream.Limiter.Overflow,
+		Tunnel:      stream.Tunnel,
+		Flags:       make([]string, 0),
+		Flagids:     make([]string, 0),
+	}
+}
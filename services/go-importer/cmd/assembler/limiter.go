@@ -0,0 +1,114 @@
+package main
+
+import (
+	"go-importer/internal/pkg/db"
+
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// Keeps a flow under the -max-flow-item-size limit. Data that does not fit is
+// dropped, or written to -overflow-dir if it is set, so large downloads can
+// still be recovered later.
+type FlowLimiter struct {
+	Stored    int
+	Truncated bool
+	Overflow  []db.FlowOverflow
+	name      string
+}
+
+func NewFlowLimiter(timestamp time.Time, net gopacket.Flow, srcPort uint16, dstPort uint16) FlowLimiter {
+	src, dst := net.Endpoints()
+	return FlowLimiter{
+		name: fmt.Sprintf("%d_%s-%d_%s-%d", timestamp.UnixMicro(), src, srcPort, dst, dstPort),
+	}
+}
+
+// Returns the part of data that still fits into the flow. The offset is the
+// position of data in the byte stream of its direction.
+func (limiter *FlowLimiter) Fit(from string, offset int, data []byte) []byte {
+	available := *maxFlowItemSize*1024*1024 - limiter.Stored
+	if available < 0 {
+		available = 0
+	}
+
+	if len(data) <= available {
+		limiter.Stored += len(data)
+		return data
+	}
+
+	limiter.Truncated = true
+	limiter.Stored += available
+	limiter.spill(from, offset+available, data[available:])
+	return data[:available]
+}
+
+func (limiter *FlowLimiter) spill(from string, offset int, data []byte) {
+	if *overflowDir == "" {
+		return
+	}
+
+	// Continue the last file of this direction if the data is contiguous,
+	// otherwise (e.g. after a gap) start a new one
+	var overflow *db.FlowOverflow
+	for i := len(limiter.Overflow) - 1; i >= 0; i-- {
+		if limiter.Overflow[i].Direction == from {
+			overflow = &limiter.Overflow[i]
+			break
+		}
+	}
+
+	// Files are only open while writing, a flow can stay open for a long time
+	// and there can be many of them
+	if overflow == nil || overflow.Offset+overflow.Size != int64(offset) {
+		path := filepath.Join(*overflowDir, fmt.Sprintf("%s_%s_%d.bin", limiter.name, from, offset))
+		file, err := os.Create(path)
+		if err != nil {
+			log.Println("Unable to create overflow file", path, err)
+			return
+		}
+		file.Close()
+
+		limiter.Overflow = append(limiter.Overflow, db.FlowOverflow{
+			Direction: from,
+			Path:      path,
+			Offset:    int64(offset),
+		})
+		overflow = &limiter.Overflow[len(limiter.Overflow)-1]
+	}
+
+	file, err := os.OpenFile(overflow.Path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		log.Println("Unable to open overflow file", overflow.Path, err)
+		return
+	}
+	defer file.Close()
+
+	written, err := file.Write(data)
+	overflow.Size += int64(written)
+	if err != nil {
+		log.Println("Unable to write overflow file", overflow.Path, err)
+	}
+}
+
+// Append items decoded from the data of a flow, e.g. websocket messages or TLS plaintext,
+// for as long as the flow stays under the -max-flow-item-size limit. The items that do
+// not fit are dropped, the data they were decoded from is still in the flow.
+// Returns the number of items that were appended.
+func appendFlowItems(flow *db.FlowEntry, items []db.FlowItem) int {
+	for i, item := range items {
+		size := flow.Size + len(item.Data)
+		if size > *maxFlowItemSize*1024*1024 {
+			return i
+		}
+
+		flow.Flow = append(flow.Flow, item)
+		flow.Size = size
+	}
+	return len(items)
+}
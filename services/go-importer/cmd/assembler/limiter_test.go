@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestFlowLimiterSpill(t *testing.T) {
+	previousDir, previousSize := *overflowDir, *maxFlowItemSize
+	*overflowDir, *maxFlowItemSize = t.TempDir(), 0
+	defer func() { *overflowDir, *maxFlowItemSize = previousDir, previousSize }()
+
+	net := gopacket.NewFlow(layers.EndpointIPv4, []byte{10, 0, 0, 1}, []byte{10, 0, 0, 2})
+	limiter := NewFlowLimiter(time.Date(2024, 11, 30, 13, 0, 0, 0, time.UTC), net, 40000, 1337)
+
+	// Contiguous data continues the file, data after a gap starts a new one
+	limiter.Fit("s", 0, []byte("hello "))
+	limiter.Fit("s", 6, []byte("world"))
+	limiter.Fit("s", 20, []byte("again"))
+
+	if !limiter.Truncated || len(limiter.Overflow) != 2 {
+		t.Fatalf("unexpected overflow: %+v", limiter.Overflow)
+	}
+	for i, expected := range []string{"hello world", "again"} {
+		data, err := os.ReadFile(limiter.Overflow[i].Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != expected || limiter.Overflow[i].Size != int64(len(expected)) {
+			t.Errorf("overflow %d has %q, expected %q", i, data, expected)
+		}
+	}
+	if limiter.Overflow[1].Offset != 20 {
+		t.Errorf("second overflow starts at %d, expected 20", limiter.Overflow[1].Offset)
+	}
+}
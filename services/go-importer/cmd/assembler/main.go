@@ -8,6 +8,7 @@ import (
 
 	"github.com/gammazero/workerpool"
 
+	"crypto/rand"
 	"flag"
 	"fmt"
 	"log"
@@ -46,6 +47,9 @@ var flag_regex = flag.String("flag", "", "flag regex, used for flag in/out taggi
 var pcap_over_ip = flag.String("pcap-over-ip", "", "PCAP-over-IP host + port (e.g. remote:1337)")
 var bpf = flag.String("bpf", "", "BPF filter")
 var nonstrict = flag.Bool("nonstrict", false, "Do not check strict TCP / FSM flags")
+var midstream = flag.Bool("midstream", false, "Pick up TCP connections whose handshake was not captured (e.g. capture started mid-connection)")
+var decapsulation = flag.Bool("decapsulate", true, `Build flows from the innermost IP header of tunneled traffic (GRE, VXLAN, GENEVE, IP-in-IP).
+The outer headers and VLAN tags are kept as flow metadata. Disable to key flows on the outer headers instead.`)
 
 var flagid = flag.Bool("flagid", false, "Check for flagids in traffic (must be present in mong)")
 var ticklength = flag.Int("tick-length", -1, "the length (in seconds) of a tick")
@@ -57,6 +61,14 @@ var flagValidatorTeam = flag.Int("flag-validator-team", -1, "Team ID used for fl
 
 var skipchecksum = flag.Bool("skipchecksum", false, "Do not check the TCP checksum")
 var http_session_tracking = flag.Bool("http-session-tracking", false, "Enable http session tracking.")
+var sessionKeysRaw = flag.String("session-keys", "cookie", `Comma separated list of what identifies a session when -http-session-tracking is enabled.
+Supported keys: cookie (every cookie name and value), bearer (Authorization bearer token), jwt-sub (sub claim of JWT bearer tokens and cookies),
+header:<name> (value of a request or response header) and form:<name> (urlencoded form or JSON field of the request body).
+Example: "cookie,jwt-sub,header:X-Session"`)
+var sessionRegex = flag.String("session-regex", "", `Regex matched against the data of every flow (including non-HTTP ones) when -http-session-tracking is enabled.
+Flows with the same match (or first capture group) are grouped into one session.`)
+var fingerprintKeyRaw = flag.String("fingerprint-key", "", `Secret key for the session fingerprints (or FINGERPRINT_KEY env).
+Keep it the same across restarts, otherwise sessions are no longer linked to flows from before the restart. A random key is used if none is set.`)
 var disableConverters = flag.Bool("disable-converters", false, "Disable converters in case they cause issues")
 var concurrentConverters = flag.Int("concurrent-converters", 2, "How many processes should be started per single converter")
 var concurrentFlows = flag.Int("concurrent-flows", 0, "How many flows should be processed at the same time")
@@ -70,10 +82,17 @@ it is not recommended setting this to a high value, since assembler persists bet
 Setting this to empty value disables TCP flushing.`)
 var flushAfterUdp = flag.String("flush-after-udp", "30s", `Same as flush-after, except for UDP connections.
 UDP connections are assembled by unique pairings of ip addressed and ports on both sides.
+ICMP echo sessions, SCTP associations and flows of other IP protocols use this timeout as well.
 The only way a UDP connection is considered closed, is if this timeout passes without seeing any new packets.
 This setting defaults to "30s" unless specified. To prevent connection flooding,
 it is not recommended setting this to a high value, since assembler persists between pcaps.
 Setting this to empty value disables UDP flushing.`)
+var udpSessionRules = flag.String("udp-session-rules", "", `Comma separated rules for splitting UDP conversations into multiple flows, in the format <port>:<rule>.
+The port is the server port of the flow, "*" applies the rule to every port without its own rules. Supported rules:
+idle=<duration> (maximum gap between packets), packets=<count> (maximum packets per flow) and dns (new flow for each DNS transaction id).
+Example: "53:dns,1234:idle=2s,*:packets=1000"`)
+var dnsPortsRaw = flag.String("dns-ports", "53", `Comma separated list of ports on which DNS is decoded, over both UDP and TCP.
+UDP flows on these ports are split per transaction id, as if they had the dns rule of udp-session-rules.`)
 var flushInterval = flag.String("flush-interval", "15s", `Period of flushing while processing one pcap.
 Any string parsed by time.ParseDuration is acceptable here (ie. "3m", "2h45m").
 Flushing always happens between pcaps, but sometimes (for example with PCAP-over-IP) it is required to flush periodically
@@ -86,6 +105,28 @@ var dumpPcapsFilename = flag.String("dump-pcaps-filename", "2006-01-02_15-04-05.
 Reference: https://pkg.go.dev/time#Layout`)
 var maxFlowItemSize = flag.Int("max-flow-item-size", 16, `Maximum size in MiB of one flow item record.
 While PostgreSQL technically supports values up to 1GiB, they are not very nice to work with.`)
+var overflowDir = flag.String("overflow-dir", "", `Directory to store the data of flows that exceeded max-flow-item-size.
+Empty string (default) drops the data that does not fit.`)
+var segmentTiming = flag.Bool("segment-timing", false, `Keep the packet boundaries and timestamps inside TCP flow items.
+Consecutive packets from one side are still merged into a single item, but their offsets and times are stored with it.`)
+var teamsSource = flag.String("teams", "", `Team map used to attribute flows to teams, either a JSON file or an http(s) URL serving the same JSON.
+Example: {"template": "10.60.{team}.0/24", "teams": [1, 2, 3], "own": 2, "gameserver": ["10.10.0.0/24"]}.
+Explicit ranges can be given per team with "ranges": {"4": ["10.61.4.0/24"]}. The map is reloaded every minute.`)
+var ticksPath = flag.String("ticks", "", `JSON file with the tick schedule, for games with irregular ticks or pauses. Reloaded every minute.
+Example: {"ticks": [{"tick": 0, "start": "2024-11-30T13:00:00Z", "length": 180}], "pauses": [{"from": "2024-11-30T15:00:00Z", "to": "2024-11-30T15:15:00Z"}]}.
+Empty string (default) uses regular ticks of -tick-length from -flag-tick-start, if both are set.`)
+var classifierPath = flag.String("classifier", "", `JSON file with the heuristics used to tag flows as checker or attack traffic, each tag comes with a confidence.
+Example: {"subnets": ["10.10.0.0/24"], "ttls": [62], "tcp_options": ["mss,sok,ts,nop,ws"], "user_agents": ["^python-requests/"]}.
+Flags, flag ids, -teams and -tls-checker-fingerprints are used as well. A flag placed and retrieved again counts across the flows
+of a session when -http-session-tracking is enabled. Empty string (default) disables the classification.`)
+var grpcDescriptorsPath = flag.String("grpc-descriptors", "", `FileDescriptorSet used to decode gRPC messages to JSON (protoc --include_imports --descriptor_set_out=...).
+Without it, gRPC messages are shown as raw protobuf.`)
+var tlsKeyLogPath = flag.String("tls-keylog", "", `NSS key log file (SSLKEYLOGFILE) used to decrypt TLS 1.2 / 1.3 sessions, reloaded whenever it changes.
+The plaintext is added to the flow next to the encrypted data, the HTTP, websocket and DNS parsers read it instead.`)
+var tlsKeysRaw = flag.String("tls-keys", "", `Comma separated list of PEM files with RSA server private keys.
+These only decrypt TLS 1.2 sessions using the RSA key exchange, everything else needs -tls-keylog.`)
+var tlsCheckerFingerprints = flag.String("tls-checker-fingerprints", "", `Comma separated JA3 / JA4 fingerprints of the checker, other TLS clients are tagged tls-unusual.
+Empty string (default) assumes the most common client of every service is the checker.`)
 
 var g_db *db.Database
 var workerPool *workerpool.WorkerPool
@@ -101,13 +142,25 @@ func reassemblyCallback(entry db.FlowEntry) {
 	// we *really* don't want to end up in a situation where we don't get any packets ingested until the converter
 	// times out.
 	workerPool.Submit(func() {
+		// TLS metadata, decrypted data is added next to the raw ciphertext
+		if contains(entry.Tags, "tcp") {
+			ParseTlsFlow(&entry)
+		}
+
 		// Parsing HTTP will decode encodings to a plaintext format
 		ParseHttpFlow(g_db, &entry)
+		ParseDnsFlow(&entry)
+
+		// Needs the results of the parsers above, converters can be selected by it
+		DetectProtocol(&entry)
 
 		if !*disableConverters {
 			converters.RunPipeline(g_db, &entry)
 		}
 
+		ApplyTeams(&entry)
+		ApplyTick(&entry)
+
 		// Apply flag in / flagout
 		if *flag_regex != "" {
 			ApplyFlagTags(&entry, flag_regex, flagValidator)
@@ -127,6 +180,12 @@ func reassemblyCallback(entry db.FlowEntry) {
 			ApplyFlagids(&entry, flagids)
 		}
 
+		// Custom tags from the tag_rule table
+		ApplyTagRules(&entry, g_db)
+
+		// Needs all tags above
+		ApplyClassifier(&entry)
+
 		// Finally, insert the new entry
 		g_db.FlowInsert(entry)
 	})
@@ -138,6 +197,7 @@ type AssemblerService struct {
 	StreamPool           *reassembly.StreamPool
 	AssemblerTcp         *reassembly.Assembler
 	AssemblerUdp         *UdpAssembler
+	AssemblerIp          *IpAssembler
 	ConnectionTcpTimeout time.Duration
 	ConnectionUdpTimeout time.Duration
 	FlushInterval        time.Duration
@@ -155,7 +215,8 @@ type AssemblerService struct {
 func NewAssemblerService() *AssemblerService {
 	streamFactory := &TcpStreamFactory{reassemblyCallback: reassemblyCallback}
 	streamPool := reassembly.NewStreamPool(streamFactory)
-	assemblerUdp := NewUdpAssembler()
+	assemblerUdp := NewUdpAssembler(reassemblyCallback)
+	assemblerIp := NewIpAssembler()
 
 	return &AssemblerService{
 		Defragmenter:  ip4defrag.NewIPv4Defragmenter(),
@@ -163,6 +224,7 @@ func NewAssemblerService() *AssemblerService {
 		StreamPool:    streamPool,
 		AssemblerTcp:  reassembly.NewAssembler(streamPool),
 		AssemblerUdp:  &assemblerUdp,
+		AssemblerIp:   &assemblerIp,
 		DumpLast:      time.Now(),
 	}
 }
@@ -190,6 +252,15 @@ func (service *AssemblerService) FlushConnections() {
 		if len(udpFlows) != 0 {
 			log.Println("Assembled", len(udpFlows), "udp flows")
 		}
+
+		ipFlows := service.AssemblerIp.CompleteOlderThan(thresholdUdp)
+		for _, flow := range ipFlows {
+			reassemblyCallback(*flow)
+		}
+
+		if len(ipFlows) != 0 {
+			log.Println("Assembled", len(ipFlows), "icmp, sctp and other ip flows")
+		}
 	}
 }
 
@@ -253,6 +324,21 @@ func main() {
 		flagTickStart = startTime
 	} 
 
+	// Tick of every flow
+	if *ticksPath == "" {
+		*ticksPath = os.Getenv("TICKS")
+	}
+	if *ticksPath != "" {
+		schedule, err := LoadTickSchedule(*ticksPath)
+		if err != nil {
+			log.Fatal("Invalid ticks: ", err)
+		}
+		tickSchedule.Store(schedule)
+		WatchTickSchedule(*ticksPath, time.Minute)
+	} else if !flagTickStart.IsZero() && *ticklength > 0 {
+		tickSchedule.Store(NewRegularTickSchedule(flagTickStart, time.Duration(*ticklength) * time.Second))
+	}
+
 	if concurrentFlows == nil || *concurrentFlows == 0 {
 		*concurrentFlows = runtime.NumCPU() / 2
 		if *concurrentFlows < 4 {
@@ -345,6 +431,112 @@ func main() {
 	service := NewAssemblerService()
 	service.BpfFilter = *bpf
 
+	// UDP session splitting
+	if *udpSessionRules == "" {
+		*udpSessionRules = os.Getenv("UDP_SESSION_RULES")
+	}
+	if err := service.AssemblerUdp.ParseRules(*udpSessionRules); err != nil {
+		log.Fatal("Invalid udp-session-rules: ", err)
+	}
+
+	// DNS decoding, the flag has a default (and may be empty to disable it)
+	// so check whether it was given instead
+	dnsPortsSet := false
+	flag.Visit(func(f *flag.Flag) {
+		dnsPortsSet = dnsPortsSet || f.Name == "dns-ports"
+	})
+	if !dnsPortsSet && os.Getenv("DNS_PORTS") != "" {
+		*dnsPortsRaw = os.Getenv("DNS_PORTS")
+	}
+	if err := ParseDnsPorts(*dnsPortsRaw); err != nil {
+		log.Fatal("Invalid dns-ports: ", err)
+	}
+	for port := range dnsPorts {
+		rule, ok := service.AssemblerUdp.Rules[port]
+		if !ok {
+			rule = service.AssemblerUdp.DefaultRule
+		}
+		rule.Dns = true
+		service.AssemblerUdp.Rules[port] = rule
+	}
+
+	// Session tracking
+	keys, err := ParseSessionKeys(*sessionKeysRaw, *sessionRegex)
+	if err != nil {
+		log.Fatal("Invalid session-keys or session-regex: ", err)
+	}
+	sessionKeys = keys
+
+	if *fingerprintKeyRaw == "" {
+		*fingerprintKeyRaw = os.Getenv("FINGERPRINT_KEY")
+	}
+	if *fingerprintKeyRaw != "" {
+		fingerprintKey = []byte(*fingerprintKeyRaw)
+	} else if *http_session_tracking {
+		log.Println("WARNING; no fingerprint key set, sessions will not be linked across restarts.")
+		fingerprintKey = make([]byte, 32)
+		if _, err := rand.Read(fingerprintKey); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Team attribution
+	if *teamsSource == "" {
+		*teamsSource = os.Getenv("TEAMS")
+	}
+	if *teamsSource != "" {
+		teams, err := LoadTeamMap(*teamsSource)
+		if err != nil {
+			log.Fatal("Invalid teams: ", err)
+		}
+		teamMap.Store(teams)
+		WatchTeamMap(*teamsSource, time.Minute)
+	}
+
+	// Checker / attack classification
+	if *classifierPath == "" {
+		*classifierPath = os.Getenv("CLASSIFIER")
+	}
+	if *classifierPath != "" {
+		var err error
+		classifier, err = LoadClassifier(*classifierPath)
+		if err != nil {
+			log.Fatal("Invalid classifier: ", err)
+		}
+	}
+
+	// gRPC decoding
+	if *grpcDescriptorsPath == "" {
+		*grpcDescriptorsPath = os.Getenv("GRPC_DESCRIPTORS")
+	}
+	if *grpcDescriptorsPath != "" {
+		if err := LoadGrpcDescriptors(*grpcDescriptorsPath); err != nil {
+			log.Fatal("Invalid grpc-descriptors: ", err)
+		}
+	}
+
+	// TLS decryption
+	if *tlsKeyLogPath == "" {
+		*tlsKeyLogPath = os.Getenv("TLS_KEYLOG")
+	}
+	if *tlsKeyLogPath != "" {
+		keyLog, err := NewTlsKeyLog(*tlsKeyLogPath)
+		if err != nil {
+			log.Fatal("Invalid tls-keylog: ", err)
+		}
+		if err := keyLog.Watch(); err != nil {
+			log.Fatal("Failed to watch tls-keylog: ", err)
+		}
+		tlsKeyLog = keyLog
+	}
+	if *tlsKeysRaw == "" {
+		*tlsKeysRaw = os.Getenv("TLS_KEYS")
+	}
+	if err := LoadTlsRsaKeys(*tlsKeysRaw); err != nil {
+		log.Fatal("Invalid tls-keys: ", err)
+	}
+	tlsClients.SetKnown(*tlsCheckerFingerprints)
+
 	// PCAP dumping parameters
 	if os.Getenv("DUMP_PCAPS") != "" {
 		*dumpPcaps = os.Getenv("DUMP_PCAPS")
@@ -371,6 +563,7 @@ func main() {
 		}
 
 		service.ConnectionTcpTimeout = flushDuration
+		service.StreamFactory.timeout = flushDuration
 	}
 
 	// Parse flush duration parameter (UDP)
@@ -573,16 +766,8 @@ func (service *AssemblerService) ProcessPcapHandle(handle *pcap.Handle, sourceNa
 		log.Println("Skipped", pcap.Position, "packets from", sourceName)
 	}
 
-	var source *gopacket.PacketSource
 	nodefrag := false
-	linktype := handle.LinkType()
-	switch linktype {
-	case layers.LinkTypeIPv4:
-		source = gopacket.NewPacketSource(handle, layers.LayerTypeIPv4)
-		break
-	default:
-		source = gopacket.NewPacketSource(handle, linktype)
-	}
+	source := gopacket.NewPacketSource(handle, linkTypeDecoder(handle.LinkType()))
 
 	source.Lazy = lazy
 	source.NoCopy = true
@@ -648,23 +833,31 @@ func (service *AssemblerService) ProcessPcapHandle(handle *pcap.Handle, sourceNa
 			}
 		}
 
-		transport := packet.TransportLayer()
+		network, inner, tunnel := decapsulate(packet)
+		if network == nil {
+			continue
+		}
+
+		transport := transportLayer(inner)
 		if transport == nil {
+			// ICMP and other IP protocols without a transport layer
+			captureInfo := packet.Metadata().CaptureInfo
+			service.AssemblerIp.Assemble(network, inner, &captureInfo, flowSourceName, tunnel)
 			continue
 		}
 
 		switch transport.LayerType() {
 		case layers.LayerTypeTCP:
 			tcp := transport.(*layers.TCP)
-			flow := packet.NetworkLayer().NetworkFlow()
+			flow := network.NetworkFlow()
 			captureInfo := packet.Metadata().CaptureInfo
 			captureInfo.AncillaryData = []interface{}{flowSourceName}
-			context := &Context{CaptureInfo: captureInfo}
+			context := &Context{CaptureInfo: captureInfo, Tunnel: tunnel, Network: network}
 
 			if !*skipchecksum {
 				// TODO: sijisu: this is broken
 				// Compute the checksum
-				tcp.SetNetworkLayerForChecksum(packet.NetworkLayer())
+				tcp.SetNetworkLayerForChecksum(network)
 				csum, err := tcp.ComputeChecksum()
 				if err != nil {
 					fmt.Printf("Failed to compute checksum: %s\n", err)
@@ -677,16 +870,18 @@ func (service *AssemblerService) ProcessPcapHandle(handle *pcap.Handle, sourceNa
 				}
 			}
 
-			service.AssemblerTcp.AssembleWithContext(flow, tcp, context)
+			service.StreamFactory.Assemble(service.AssemblerTcp, flow, tcp, context)
 			break
 		case layers.LayerTypeUDP:
 			udp := transport.(*layers.UDP)
-			flow := packet.NetworkLayer().NetworkFlow()
+			flow := network.NetworkFlow()
 			captureInfo := packet.Metadata().CaptureInfo
-			service.AssemblerUdp.Assemble(flow, udp, &captureInfo, flowSourceName)
+			service.AssemblerUdp.Assemble(flow, udp, &captureInfo, flowSourceName, tunnel)
 			break
 		default:
-			// pass
+			// SCTP and other transports we don't reassemble ourselves
+			captureInfo := packet.Metadata().CaptureInfo
+			service.AssemblerIp.Assemble(network, inner, &captureInfo, flowSourceName, tunnel)
 		}
 
 		select {
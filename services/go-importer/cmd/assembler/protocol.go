@@ -0,0 +1,179 @@
+package main
+
+import (
+	"go-importer/internal/pkg/db"
+
+	"bytes"
+	"errors"
+	"io"
+	"regexp"
+	"unicode/utf8"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Amount of data of each direction looked at by the content checks
+const protocolSniffSize = 4096
+
+var protocolHttpRequest = regexp.MustCompile(`^[A-Z]{3,10} \S+ HTTP/1\.[01]\r?\n`)
+var protocolHttpResponse = regexp.MustCompile(`^HTTP/1\.[01] \d{3}`)
+var protocolRedis = regexp.MustCompile(`^\*\d+\r\n\$\d+\r\n`)
+
+// Classify a flow by its content, the result is stored as its protocol and added to its tags.
+// Flows without any data are not classified.
+func DetectProtocol(flow *db.FlowEntry) {
+	protocol := detectProtocol(flow)
+	if protocol == "" {
+		return
+	}
+
+	flow.Protocol = protocol
+	if !contains(flow.Tags, protocol) {
+		flow.Tags = append(flow.Tags, protocol)
+	}
+}
+
+func detectProtocol(flow *db.FlowEntry) string {
+	// Anything the parsers already understood
+	for _, tag := range []string{"grpc", "websocket", "http2", "http"} {
+		if contains(flow.Tags, tag) {
+			return tag
+		}
+	}
+	if flow.Tls != nil {
+		return "tls"
+	}
+	if len(flow.Dns) != 0 {
+		return "dns"
+	}
+
+	client := protocolSniff(flow, "c")
+	server := protocolSniff(flow, "s")
+	if len(client) == 0 && len(server) == 0 {
+		return ""
+	}
+
+	switch {
+	case bytes.HasPrefix(client, []byte("SSH-")) || bytes.HasPrefix(server, []byte("SSH-")):
+		return "ssh"
+	case bytes.HasPrefix(client, []byte(http2Preface)):
+		return "http2"
+	case protocolHttpRequest.Match(client) || protocolHttpResponse.Match(server):
+		return "http"
+	case len(client) >= 3 && client[0] == tlsRecordHandshake && client[1] == 3 && client[2] <= 4:
+		return "tls"
+	case protocolRedis.Match(client):
+		return "redis"
+	case protocolMqtt(client):
+		return "mqtt"
+	case protocolText(client) && protocolText(server):
+		return "text"
+	case protocolMsgpack(client):
+		return "msgpack"
+	case protocolProtobuf(client):
+		return "protobuf"
+	}
+	return "binary"
+}
+
+// Start of the data of one direction, up to the first gap
+func protocolSniff(flow *db.FlowEntry, from string) []byte {
+	data := []byte{}
+	kind := flowDataKind(flow)
+	for _, item := range flow.Flow {
+		if item.Kind != kind || item.From != from {
+			continue
+		}
+		if item.Meta.Gap != nil || len(data) >= protocolSniffSize {
+			break
+		}
+		data = append(data, item.Data...)
+	}
+
+	if len(data) > protocolSniffSize {
+		data = data[:protocolSniffSize]
+	}
+	return data
+}
+
+// CONNECT packet of MQTT 3.1 or later
+func protocolMqtt(data []byte) bool {
+	if len(data) < 2 || data[0] != 0x10 {
+		return false
+	}
+
+	// Remaining length is a varint of up to 4 bytes
+	i := 1
+	for ; i < len(data) && i <= 4; i++ {
+		if data[i]&0x80 == 0 {
+			break
+		}
+	}
+	if i >= len(data) || i > 4 {
+		return false
+	}
+
+	name := data[i+1:]
+	return bytes.HasPrefix(name, []byte("\x00\x04MQTT")) || bytes.HasPrefix(name, []byte("\x00\x06MQIsdp"))
+}
+
+// Mostly printable and valid UTF-8, an empty direction does not count against it
+func protocolText(data []byte) bool {
+	// The sniffed data may end in the middle of a character
+	for i := 0; i < utf8.UTFMax && len(data) != 0 && !utf8.Valid(data); i++ {
+		data = data[:len(data)-1]
+	}
+	if !utf8.Valid(data) {
+		return false
+	}
+
+	printable := 0
+	for _, r := range string(data) {
+		if r == '\n' || r == '\r' || r == '\t' || r >= ' ' && r != 0x7f {
+			printable++
+		}
+	}
+	return printable*10 >= utf8.RuneCount(data)*9
+}
+
+// One or more msgpack maps or arrays and nothing else
+func protocolMsgpack(data []byte) bool {
+	if len(data) == 0 {
+		return false
+	}
+	// fixmap, fixarray, array 16/32, map 16/32
+	if !(data[0] >= 0x80 && data[0] <= 0x9f) && !(data[0] >= 0xdc && data[0] <= 0xdf) {
+		return false
+	}
+
+	decoder := msgpack.NewDecoder(bytes.NewReader(data))
+	for {
+		if err := decoder.Skip(); err != nil {
+			return errors.Is(err, io.EOF)
+		}
+	}
+}
+
+// A protobuf message that spans the data exactly
+func protocolProtobuf(data []byte) bool {
+	if len(data) < 2 {
+		return false
+	}
+
+	for len(data) != 0 {
+		number, kind, n := protowire.ConsumeTag(data)
+		// Real messages rarely use large field numbers, random data does
+		if n < 0 || number > 1<<16 || kind == protowire.StartGroupType || kind == protowire.EndGroupType {
+			return false
+		}
+		data = data[n:]
+
+		n = protowire.ConsumeFieldValue(number, kind, data)
+		if n < 0 {
+			return false
+		}
+		data = data[n:]
+	}
+	return true
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"go-importer/internal/pkg/db"
+
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// Which parts of the traffic identify a session, see -session-keys.
+// Flows sharing a session key end up with the same fingerprint and are grouped together.
+type SessionKeys struct {
+	Cookie  bool
+	Bearer  bool
+	JwtSub  bool
+	Headers []string
+	Forms   []string
+	Regex   *regexp.Regexp
+}
+
+var sessionKeys = SessionKeys{Cookie: true}
+
+func ParseSessionKeys(raw string, rawRegex string) (SessionKeys, error) {
+	keys := SessionKeys{}
+
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		kind, name, _ := strings.Cut(part, ":")
+		switch kind {
+		case "cookie":
+			keys.Cookie = true
+		case "bearer":
+			keys.Bearer = true
+		case "jwt-sub":
+			keys.JwtSub = true
+		case "header":
+			if name == "" {
+				return keys, fmt.Errorf("missing header name in %q", part)
+			}
+			keys.Headers = append(keys.Headers, http.CanonicalHeaderKey(name))
+		case "form":
+			if name == "" {
+				return keys, fmt.Errorf("missing field name in %q", part)
+			}
+			keys.Forms = append(keys.Forms, name)
+		default:
+			return keys, fmt.Errorf("unknown session key %q", part)
+		}
+	}
+
+	if rawRegex != "" {
+		regex, err := regexp.Compile(rawRegex)
+		if err != nil {
+			return keys, err
+		}
+		keys.Regex = regex
+	}
+
+	return keys, nil
+}
+
+// Key of the fingerprint hash, see -fingerprint-key
+var fingerprintKey []byte
+
+// Keyed 64 bit hash of a session key, so nobody can craft collisions with other sessions
+// and unrelated flows don't end up linked by chance
+func sessionFingerprint(kind string, value string) uint64 {
+	mac := hmac.New(sha256.New, fingerprintKey)
+	mac.Write([]byte(url.QueryEscape(kind)))
+	mac.Write([]byte("="))
+	mac.Write([]byte(url.QueryEscape(value)))
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+func addSessionFingerprint(kind string, value string, fingerPrints map[uint64]bool) {
+	if value == "" {
+		return
+	}
+
+	// The kind takes the place of the cookie name
+	fingerPrints[sessionFingerprint(kind, value)] = true
+}
+
+// Subject of a JWT, or an empty string if the value is not a JWT.
+// The signature is not checked, we only want to know who the token claims to be.
+func jwtSubject(token string) string {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil || !gjson.ValidBytes(payload) {
+		return ""
+	}
+
+	return gjson.GetBytes(payload, "sub").String()
+}
+
+func bearerToken(header http.Header) string {
+	scheme, token, ok := strings.Cut(header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+func (keys SessionKeys) FromRequest(req *http.Request, body []byte, fingerPrints map[uint64]bool) {
+	if keys.Cookie {
+		AddFingerprints(req.Cookies(), fingerPrints)
+	}
+
+	keys.fromHeaders(req.Header, req.Cookies(), fingerPrints)
+
+	if len(keys.Forms) == 0 || len(body) == 0 {
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	switch {
+	case mediaType == "application/x-www-form-urlencoded":
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return
+		}
+		for _, name := range keys.Forms {
+			addSessionFingerprint("form:"+name, form.Get(name), fingerPrints)
+		}
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		if !gjson.ValidBytes(body) {
+			return
+		}
+		for _, name := range keys.Forms {
+			addSessionFingerprint("form:"+name, gjson.GetBytes(body, name).String(), fingerPrints)
+		}
+	}
+}
+
+func (keys SessionKeys) FromResponse(res *http.Response, fingerPrints map[uint64]bool) {
+	if keys.Cookie {
+		AddFingerprints(res.Cookies(), fingerPrints)
+	}
+
+	keys.fromHeaders(res.Header, res.Cookies(), fingerPrints)
+}
+
+func (keys SessionKeys) fromHeaders(header http.Header, cookies []*http.Cookie, fingerPrints map[uint64]bool) {
+	token := bearerToken(header)
+	if keys.Bearer {
+		addSessionFingerprint("bearer", token, fingerPrints)
+	}
+
+	if keys.JwtSub {
+		// Tokens are passed around as bearer tokens and cookies alike
+		addSessionFingerprint("jwt-sub", jwtSubject(token), fingerPrints)
+		for _, cookie := range cookies {
+			addSessionFingerprint("jwt-sub", jwtSubject(cookie.Value), fingerPrints)
+		}
+	}
+
+	for _, name := range keys.Headers {
+		addSessionFingerprint("header:"+name, header.Get(name), fingerPrints)
+	}
+}
+
+// Match the session regex against the raw data of any flow, not just HTTP.
+// The first capture group is used as the key if there is one, the whole match otherwise.
+func (keys SessionKeys) FromFlow(flow *db.FlowEntry, fingerPrints map[uint64]bool) {
+	if keys.Regex == nil {
+		return
+	}
+
+	group := 0
+	if keys.Regex.NumSubexp() > 0 {
+		group = 1
+	}
+
+	for _, item := range flow.Flow {
+		if item.Kind != "raw" {
+			continue
+		}
+
+		for _, match := range keys.Regex.FindAllSubmatch(item.Data, -1) {
+			addSessionFingerprint("regex", string(bytes.TrimSpace(match[group])), fingerPrints)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"go-importer/internal/pkg/db"
+
+	"log"
+	"regexp"
+	"sync"
+
+	"github.com/cloudflare/ahocorasick"
+)
+
+// Rules of the tag_rule table compiled into a single multi-pattern matcher.
+// Byte patterns are matched directly, regexes only run on data that contains
+// their literal prefix (if they have one).
+type TagRuleMatcher struct {
+	version int
+	rules   []db.TagRule
+	regexes []*regexp.Regexp
+	// Pattern of the matcher -> indices of the rules it belongs to
+	patterns [][]int
+	matcher  *ahocorasick.Matcher
+	// Rules without a usable literal, checked on every item
+	always []int
+}
+
+var tagRuleMatcher *TagRuleMatcher
+var tagRuleMatcherMutex sync.Mutex
+
+func NewTagRuleMatcher(rules []db.TagRule, version int) *TagRuleMatcher {
+	matcher := &TagRuleMatcher{
+		version: version,
+		rules:   rules,
+		regexes: make([]*regexp.Regexp, len(rules)),
+	}
+
+	literals := [][]byte{}
+	indices := map[string]int{}
+	addLiteral := func(literal []byte, rule int) {
+		index, ok := indices[string(literal)]
+		if !ok {
+			index = len(literals)
+			indices[string(literal)] = index
+			literals = append(literals, literal)
+			matcher.patterns = append(matcher.patterns, nil)
+		}
+		matcher.patterns[index] = append(matcher.patterns[index], rule)
+	}
+
+	for i, rule := range rules {
+		if rule.Regex == nil {
+			if len(rule.Bytes) == 0 {
+				log.Printf("Tag rule %d has no pattern, ignoring it\n", rule.Id)
+				continue
+			}
+			addLiteral(rule.Bytes, i)
+			continue
+		}
+
+		regex, err := regexp.Compile(*rule.Regex)
+		if err != nil {
+			log.Printf("Invalid regex in tag rule %d, ignoring it: %s\n", rule.Id, err)
+			continue
+		}
+		matcher.regexes[i] = regex
+
+		// Case insensitive regexes report no prefix, so this stays correct
+		if prefix, _ := regex.LiteralPrefix(); prefix != "" {
+			addLiteral([]byte(prefix), i)
+		} else {
+			matcher.always = append(matcher.always, i)
+		}
+	}
+
+	matcher.matcher = ahocorasick.NewMatcher(literals)
+	return matcher
+}
+
+// Rules matching the data, the regexes are only run if needed
+func (matcher *TagRuleMatcher) match(data []byte, applies func(rule *db.TagRule) bool, matched []bool) {
+	check := func(i int) {
+		if matched[i] || !applies(&matcher.rules[i]) {
+			return
+		}
+		if regex := matcher.regexes[i]; regex != nil && !regex.Match(data) {
+			return
+		}
+		matched[i] = true
+	}
+
+	// Flows are tagged by several workers at once
+	for _, pattern := range matcher.matcher.MatchThreadSafe(data) {
+		for _, i := range matcher.patterns[pattern] {
+			check(i)
+		}
+	}
+	for _, i := range matcher.always {
+		check(i)
+	}
+}
+
+// Add the tags of all matching rules of the tag_rule table, in the order of
+// their priority. Rules are matched against every item of the flow, like the flags.
+func ApplyTagRules(flow *db.FlowEntry, database *db.Database) {
+	rules, version := database.TagRules()
+	if len(rules) == 0 {
+		return
+	}
+
+	// The rules only change when someone edits them, so this rarely recompiles.
+	// Another worker may have compiled newer rules since we got ours.
+	tagRuleMatcherMutex.Lock()
+	if tagRuleMatcher == nil || version > tagRuleMatcher.version {
+		tagRuleMatcher = NewTagRuleMatcher(rules, version)
+	}
+	matcher := tagRuleMatcher
+	tagRuleMatcherMutex.Unlock()
+
+	matched := make([]bool, len(matcher.rules))
+	for _, item := range flow.Flow {
+		applies := func(rule *db.TagRule) bool {
+			if rule.Direction != "" && rule.Direction != item.From {
+				return false
+			}
+			return rule.Port == nil || uint16(*rule.Port) == flow.Dst_port
+		}
+		matcher.match(item.Data, applies, matched)
+	}
+
+	for i, rule := range matcher.rules {
+		if matched[i] && !contains(flow.Tags, rule.Tag) {
+			flow.Tags = append(flow.Tags, rule.Tag)
+		}
+	}
+}
@@ -70,6 +70,15 @@ func ApplyFlagTags(flow *db.FlowEntry, reg *string, flagValidator FlagValidator)
 				if !contains(flow.Flags, flag) {
 					flow.Flags = append(flow.Flags, flag)
 				}
+				// Tick of its first occurrence
+				if _, ok := flow.Flag_ticks[flag]; !ok {
+					if tick := tickAt(flowItem.Time); tick != nil {
+						if flow.Flag_ticks == nil {
+							flow.Flag_ticks = map[string]int{}
+						}
+						flow.Flag_ticks[flag] = *tick
+					}
+				}
 				// Check if it is a fake flag
 				if !hasFakeFlag && !flagValidator.IsValid(flag, flowItem.Time) {
 					tags = append(tags, "fake-flag")
@@ -10,16 +10,21 @@ package main
 
 import (
 	"go-importer/internal/pkg/db"
+	"log"
 	"net/netip"
 
 	"sync"
+	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/reassembly"
 )
 
-var allowmissinginit = true
+// Mirrors the unexported value the reassembly package uses for a direction
+// that has not started yet
+const invalidSequence = reassembly.Sequence(-1)
+
 var verbose = false
 var debug = false
 var quiet = true
@@ -29,12 +34,27 @@ var quiet = true
  */
 type TcpStreamFactory struct {
 	reassemblyCallback func(db.FlowEntry)
+	// Stream whose 4-tuple was just reused by a new connection, see CloseReused
+	reused             *TcpStream
+	// Capture time of the newest packet, streams that were idle for timeout
+	// before it timed out, see ReassemblyComplete
+	lastSeen           time.Time
+	timeout            time.Duration
 }
 
 func (factory *TcpStreamFactory) New(net, transport gopacket.Flow, tcp *layers.TCP, ac reassembly.AssemblerContext) reassembly.Stream {
 	source := ac.GetCaptureInfo().AncillaryData[0].(string);
+	var tunnel []db.FlowTunnel
+	var fingerprint *db.FlowTcpFingerprint
+	if context, ok := ac.(*Context); ok {
+		tunnel = context.Tunnel
+		// The stream starts with the SYN of the client if the handshake was captured
+		if tcp.SYN && !tcp.ACK {
+			fingerprint = NewTcpFingerprint(context.Network, tcp)
+		}
+	}
 	fsmOptions := reassembly.TCPSimpleFSMOptions{
-		SupportMissingEstablishment: *nonstrict,
+		SupportMissingEstablishment: *nonstrict || *midstream,
 	}
 	stream := &TcpStream{
 		net:                net,
@@ -45,16 +65,88 @@ func (factory *TcpStreamFactory) New(net, transport gopacket.Flow, tcp *layers.T
 		FlowItems:          []db.FlowItem{},
 		src_port:           tcp.SrcPort,
 		dst_port:           tcp.DstPort,
+		limiter:            NewFlowLimiter(ac.GetCaptureInfo().Timestamp, net, uint16(tcp.SrcPort), uint16(tcp.DstPort)),
+		tunnel:             tunnel,
+		fingerprint:        fingerprint,
+		factory:            factory,
 		reassemblyCallback: factory.reassemblyCallback,
 	}
 	return stream
 }
 
+// Finish the stream whose 4-tuple was reused by the packet that was just assembled.
+// The assembler keys connections by their 4-tuple only, so the old stream has
+// to be closed before the packet can start a new one. Returns whether the packet
+// has to be assembled again.
+func (factory *TcpStreamFactory) CloseReused(assembler *reassembly.Assembler, context *Context) bool {
+	stream := factory.reused
+	if stream == nil {
+		return false
+	}
+	factory.reused = nil
+
+	// An RST that does not skip any data closes a half right away, once both
+	// are closed the stream is complete and removed from the pool
+	stream.closing = true
+	halves := []struct {
+		net      gopacket.Flow
+		src, dst layers.TCPPort
+		seq      reassembly.Sequence
+	}{
+		{stream.net, stream.src_port, stream.dst_port, stream.client.nextSeq},
+		{stream.net.Reverse(), stream.dst_port, stream.src_port, stream.server.nextSeq},
+	}
+	for _, half := range halves {
+		rst, err := newTcpReset(half.src, half.dst, uint32(half.seq))
+		if err != nil {
+			log.Println("Failed to close reused stream: ", err)
+			continue
+		}
+		assembler.AssembleWithContext(half.net, rst, context)
+	}
+	return true
+}
+
+// Assemble a packet, a packet that reuses the 4-tuple of an old stream starts a new one
+func (factory *TcpStreamFactory) Assemble(assembler *reassembly.Assembler, flow gopacket.Flow, tcp *layers.TCP, context *Context) {
+	if context.CaptureInfo.Timestamp.After(factory.lastSeen) {
+		factory.lastSeen = context.CaptureInfo.Timestamp
+	}
+	assembler.AssembleWithContext(flow, tcp, context)
+	if factory.CloseReused(assembler, context) {
+		assembler.AssembleWithContext(flow, tcp, context)
+	}
+}
+
+// The assembler keys streams by TransportFlow, which is only set when decoding
+// a header, so the RST is serialized and decoded again
+func newTcpReset(src, dst layers.TCPPort, seq uint32) (*layers.TCP, error) {
+	header := &layers.TCP{
+		SrcPort: src,
+		DstPort: dst,
+		Seq:     seq,
+		RST:     true,
+	}
+	buffer := gopacket.NewSerializeBuffer()
+	if err := header.SerializeTo(buffer, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+		return nil, err
+	}
+
+	rst := &layers.TCP{}
+	if err := rst.DecodeFromBytes(buffer.Bytes(), gopacket.NilDecodeFeedback); err != nil {
+		return nil, err
+	}
+	return rst, nil
+}
+
 /*
  * The assembler context
  */
 type Context struct {
 	CaptureInfo gopacket.CaptureInfo
+	Tunnel      []db.FlowTunnel
+	// Innermost IP header
+	Network     gopacket.NetworkLayer
 }
 
 func (c *Context) GetCaptureInfo() gopacket.CaptureInfo {
@@ -80,77 +172,265 @@ type TcpStream struct {
 	dst_port           layers.TCPPort
 	total_size         int
 	num_packets        int
+	tags               []string
+	client             tcpDirection
+	server             tcpDirection
+	limiter            FlowLimiter
+	tunnel             []db.FlowTunnel
+	fingerprint        *db.FlowTcpFingerprint
+	factory            *TcpStreamFactory
+	// Being closed by CloseReused
+	closing            bool
+	rst                bool
+	// Capture time of the newest packet of this stream
+	lastSeen           time.Time
+	retransmissions    int
+	out_of_order       int
+}
+
+type tcpDirection struct {
+	// Position in the byte stream, including missing bytes
+	offset  int
+	// Number of bytes captured, including the ones that were truncated
+	size    int
+	started bool
+	// Flags seen in this direction, see Accept
+	syn     bool
+	fin     bool
+	// Initial sequence number, valid if syn is set
+	isn     uint32
+	// Sequence number at or before the one the assembler expects next,
+	// see CloseReused
+	nextSeq reassembly.Sequence
 }
 
 func (t *TcpStream) Accept(tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection, nextSeq reassembly.Sequence, start *bool, ac reassembly.AssemblerContext) bool {
+	if ci.Timestamp.After(t.lastSeen) {
+		t.lastSeen = ci.Timestamp
+	}
+	if t.closing {
+		// The halves that never started need the RST as their start to close
+		*start = nextSeq == invalidSequence
+		return true
+	}
+
+	// A new connection on the same 4-tuple, e.g. a client reusing its source port
+	// while this one is still closing (TIME_WAIT). Retransmitted SYNs keep their
+	// sequence number.
+	if tcp.SYN && !tcp.ACK && t.reusedBy(tcp, dir) {
+		t.factory.reused = t
+		return false
+	}
+
 	// FSM
 	if !t.tcpstate.CheckState(tcp, dir) {
 		if !t.fsmerr {
 			t.fsmerr = true
 		}
-		if !*nonstrict {
+		if !*nonstrict && !*midstream {
 			return false
 		}
 	}
 
+	// The handshake for this direction was not captured, start reassembling
+	// from this packet instead of waiting for a SYN that will never come
+	if *midstream && nextSeq == invalidSequence && !tcp.SYN {
+		*start = true
+	}
+
+	t.trackConnection(tcp, dir, nextSeq)
 	return true
 }
 
+func (t *TcpStream) reusedBy(syn *layers.TCP, dir reassembly.TCPFlowDirection) bool {
+	half := &t.server
+	if dir == reassembly.TCPDirClientToServer {
+		half = &t.client
+	}
+
+	if half.syn && syn.Seq != half.isn {
+		return true
+	}
+	return t.rst || t.client.fin || t.server.fin
+}
+
+// Keep the connection metadata of an accepted packet, the retransmissions and
+// out of order segments are relative to the data reassembled so far
+func (t *TcpStream) trackConnection(tcp *layers.TCP, dir reassembly.TCPFlowDirection, nextSeq reassembly.Sequence) {
+	half := &t.server
+	if dir == reassembly.TCPDirClientToServer {
+		half = &t.client
+	}
+	if tcp.SYN && !half.syn {
+		half.isn = tcp.Seq
+	}
+	half.syn = half.syn || tcp.SYN
+	half.fin = half.fin || tcp.FIN
+	// If this packet starts the direction, the assembler continues from it
+	half.nextSeq = nextSeq
+	if nextSeq == invalidSequence {
+		half.nextSeq = reassembly.Sequence(tcp.Seq)
+	}
+	t.rst = t.rst || tcp.RST
+
+	// Pure ACKs do not take up any sequence numbers
+	length := len(tcp.Payload)
+	if tcp.SYN || tcp.FIN {
+		length++
+	}
+	if length == 0 || nextSeq == invalidSequence {
+		return
+	}
+
+	diff := nextSeq.Difference(reassembly.Sequence(tcp.Seq))
+	switch {
+	case diff == -1 && length == 1 && !tcp.SYN && !tcp.FIN:
+		// Keep-alive, repeats the last byte on purpose
+	case diff < 0:
+		t.retransmissions++
+	case diff > 0:
+		t.out_of_order++
+	}
+}
+
 // ReassembledSG is called zero or more times.
 // ScatterGather is reused after each Reassembled call,
 // so it's important to copy anything you need out of it,
 // especially bytes (or use KeepFrom())
 func (t *TcpStream) ReassembledSG(sg reassembly.ScatterGather, ac reassembly.AssemblerContext) {
-	dir, _, _, _ := sg.Info()
+	dir, start, _, skip := sg.Info()
 	length, _ := sg.Lengths()
+	// The RST of CloseReused was not captured
+	if t.closing && length == 0 {
+		return
+	}
 	capInfo := ac.GetCaptureInfo()
 	timestamp := capInfo.Timestamp
 	t.num_packets += 1
 
+	var from string
+	var half *tcpDirection
+	if dir == reassembly.TCPDirClientToServer {
+		from = "c"
+		half = &t.client
+	} else {
+		from = "s"
+		half = &t.server
+	}
+
+	// SYN was seen, this direction is complete from the beginning
+	if start {
+		half.started = true
+	}
+
 	// Don't add empty streams to the DB
 	if length == 0 {
 		return
 	}
 
+	// Mark data that is missing before this chunk. Either we never saw the
+	// beginning of this direction (mid-stream pickup, skip is unknown), or
+	// some segments were lost and the assembler skipped over them.
+	if !half.started || skip < 0 {
+		t.addGap(from, half.offset, -1, timestamp)
+		t.addTag("incomplete")
+	} else if skip > 0 {
+		t.addGap(from, half.offset, skip, timestamp)
+		t.addTag("gap")
+		half.offset += skip
+	}
+	half.started = true
+
 	data := sg.Fetch(length)
+	t.total_size += length
+	half.size += length
 
 	// We have to make sure to stay under the document limit
-	t.total_size += length
-	bytes_available := (*maxFlowItemSize * 1024 * 1024) - t.total_size
-	if length > bytes_available {
-		length = bytes_available
-	}
-	if length < 0 {
-		length = 0
-	}
-	data = data[:length]
+	data = t.limiter.Fit(from, half.offset, data)
+	half.offset += length
+	length = len(data)
 
-	var from string
-	if dir == reassembly.TCPDirClientToServer {
-		from = "c"
-	} else {
-		from = "s"
+	var segments []segment
+	if *segmentTiming {
+		segments = sgSegments(sg, length)
 	}
 
 	// consolidate subsequent elements from the same origin
 	l := len(t.FlowItems)
 	if l > 0 {
-		if t.FlowItems[l-1].From == from {
-			t.FlowItems[l-1].Data = append(t.FlowItems[l-1].Data, data...)
+		if t.FlowItems[l-1].From == from && t.FlowItems[l-1].Meta.Gap == nil {
+			item := &t.FlowItems[l-1]
+			item.Meta.Segments = appendSegments(item.Meta.Segments, segments, len(item.Data), item.Time)
+			item.Data = append(item.Data, data...)
 			// All done, no need to add a new item
 			return
 		}
 	}
 
 	// Add a FlowItem based on the data we just reassembled
+	// Fetch may return memory owned by the assembler, so copy it
 	t.FlowItems = append(t.FlowItems, db.FlowItem{
 		Kind: "raw",
 		From: from,
-		Data: data,
+		Data: append([]byte{}, data...),
 		Time: timestamp,
+		Meta: db.FlowItemMeta{
+			Segments: appendSegments(nil, segments, 0, timestamp),
+		},
 	})
 }
 
+type segment struct {
+	offset    int
+	timestamp time.Time
+}
+
+// Find the packet boundaries inside the reassembled data. ScatterGather only
+// exposes the capture info of the packet at a given offset, so we walk the offsets
+// and start a segment wherever it changes. Packets are not in timestamp order
+// when the assembler had to wait for a retransmission, so this can't skip ahead.
+func sgSegments(sg reassembly.ScatterGather, length int) []segment {
+	var segments []segment
+	var last gopacket.CaptureInfo
+	for offset := 0; offset < length; offset++ {
+		info := sg.CaptureInfo(offset)
+		if offset > 0 && info.Timestamp.Equal(last.Timestamp) && info.Length == last.Length {
+			continue
+		}
+		segments = append(segments, segment{offset, info.Timestamp})
+		last = info
+	}
+	return segments
+}
+
+// Convert segments to (offset, microseconds) pairs relative to the flow item
+func appendSegments(pairs [][2]int64, segments []segment, base int, itemTime time.Time) [][2]int64 {
+	for _, s := range segments {
+		pairs = append(pairs, [2]int64{int64(base + s.offset), s.timestamp.Sub(itemTime).Microseconds()})
+	}
+	return pairs
+}
+
+// Insert an empty marker item for data that was never captured, so that the data
+// around it is not presented as one contiguous chunk
+func (t *TcpStream) addGap(from string, offset int, size int, timestamp time.Time) {
+	t.FlowItems = append(t.FlowItems, db.FlowItem{
+		Kind: "raw",
+		From: from,
+		Data: []byte{},
+		Time: timestamp,
+		Meta: db.FlowItemMeta{
+			Gap: &db.FlowGap{Offset: offset, Size: size},
+		},
+	})
+}
+
+func (t *TcpStream) addTag(tag string) {
+	if !contains(t.tags, tag) {
+		t.tags = append(t.tags, tag)
+	}
+}
+
 // ReassemblyComplete is called when assembly decides there is
 // no more data for this Stream, either because a FIN or RST packet
 // was seen, or because the stream has timed out without any new
@@ -159,10 +439,36 @@ func (t *TcpStream) ReassembledSG(sg reassembly.ScatterGather, ac reassembly.Ass
 // It can return false if it want to see subsequent packets with Accept(), e.g. to
 // see FIN-ACK, for deeper state-machine analysis.
 func (t *TcpStream) ReassemblyComplete(ac reassembly.AssemblerContext) bool {
+	if t.limiter.Truncated {
+		t.addTag("truncated")
+	}
+
+	// Both halves are closed at this point, either by FIN / RST, because
+	// FlushCloseOlderThan gave up on them or because of CloseReused.
+	// The importer also flushes connections that are still active, e.g. at
+	// the end of every pcap, those did not time out.
+	closeReason := "timeout"
+	if t.rst {
+		closeReason = "rst"
+	} else if t.client.fin && t.server.fin {
+		closeReason = "fin"
+	} else if t.closing {
+		closeReason = "reused"
+	} else if t.factory.lastSeen.Sub(t.lastSeen) < t.factory.timeout {
+		closeReason = "flushed"
+	}
+	if closeReason != "fin" {
+		t.addTag(closeReason)
+	}
+	handshake := t.client.syn && t.server.syn
+	if !handshake {
+		t.addTag("no-handshake")
+	}
+
 	if len(t.FlowItems) == 0 {
 		// No point in inserting this element, it has no data and even if we wanted to,
 		// we can't timestamp it so the front-end can't display it either
-		return false
+		return true
 	}
 
 	src, dst := t.net.Endpoints()
@@ -178,25 +484,35 @@ func (t *TcpStream) ReassemblyComplete(ac reassembly.AssemblerContext) bool {
 	}
 
 	entry := db.FlowEntry{
-		Src_port:    uint16(t.src_port),
-		Dst_port:    uint16(t.dst_port),
-		Src_ip:      ip_src,
-		Dst_ip:      ip_dst,
-		Time:        timeStart,
-		Duration:    timeEnd.Sub(timeStart),
-		Num_packets: t.num_packets,
-		Parent_id:   nil,
-		Child_id:    nil,
-		Tags:        []string { "tcp" },
-		Filename:    t.source,
-		Flow:        t.FlowItems,
-		Size:        t.total_size,
-		Flags:       make([]string, 0),
-		Flagids:     make([]string, 0),
+		Src_port:        uint16(t.src_port),
+		Dst_port:        uint16(t.dst_port),
+		Src_ip:          ip_src,
+		Dst_ip:          ip_dst,
+		Time:            timeStart,
+		Duration:        timeEnd.Sub(timeStart),
+		Num_packets:     t.num_packets,
+		Parent_id:       nil,
+		Child_id:        nil,
+		Tags:            append([]string { "tcp" }, t.tags...),
+		Filename:        t.source,
+		Flow:            t.FlowItems,
+		Size:            t.total_size,
+		Size_Client:     int64(t.client.size),
+		Size_Server:     int64(t.server.size),
+		Overflow:        t.limiter.Overflow,
+		Tunnel:          t.tunnel,
+		Tcp_fingerprint: t.fingerprint,
+		Close_reason:    closeReason,
+		Handshake:       handshake,
+		Retransmissions: t.retransmissions,
+		Out_of_order:    t.out_of_order,
+		Flags:           make([]string, 0),
+		Flagids:         make([]string, 0),
 	}
 
 	t.reassemblyCallback(entry)
 
-	// do not remove the connection to allow last ACK
-	return false
+	// Remove the connection, so that a new connection on the same 4-tuple gets
+	// a new stream. A trailing ACK starts an empty stream that is never inserted.
+	return true
 }
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"go-importer/internal/pkg/db"
+
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Passive fingerprint of the stack that sent a SYN, following p0f 3.
+// NATs rewrite the addresses but usually keep the rest of the headers,
+// so this tells apart machines behind the same router.
+func NewTcpFingerprint(network gopacket.NetworkLayer, tcp *layers.TCP) *db.FlowTcpFingerprint {
+	fingerprint := &db.FlowTcpFingerprint{
+		Window:  tcp.Window,
+		Options: tcpOptionLayout(tcp),
+		Quirks:  []string{},
+		Payload: len(tcp.Payload) != 0,
+	}
+
+	switch ip := network.(type) {
+	case *layers.IPv4:
+		fingerprint.Version = 4
+		fingerprint.Ttl = ip.TTL
+		fingerprint.IpOptions = int(ip.IHL)*4 - 20
+		dontFragment := ip.Flags&layers.IPv4DontFragment != 0
+		if dontFragment {
+			fingerprint.Quirks = append(fingerprint.Quirks, "df")
+		}
+		// Stacks setting DF usually leave the id at zero
+		if dontFragment && ip.Id != 0 {
+			fingerprint.Quirks = append(fingerprint.Quirks, "id+")
+		}
+		if !dontFragment && ip.Id == 0 {
+			fingerprint.Quirks = append(fingerprint.Quirks, "id-")
+		}
+		if ip.TOS&0x03 != 0 {
+			fingerprint.Quirks = append(fingerprint.Quirks, "ecn")
+		}
+		if ip.Flags&layers.IPv4EvilBit != 0 {
+			fingerprint.Quirks = append(fingerprint.Quirks, "0+")
+		}
+	case *layers.IPv6:
+		fingerprint.Version = 6
+		fingerprint.Ttl = ip.HopLimit
+		if ip.TrafficClass&0x03 != 0 {
+			fingerprint.Quirks = append(fingerprint.Quirks, "ecn")
+		}
+		if ip.FlowLabel != 0 {
+			fingerprint.Quirks = append(fingerprint.Quirks, "flow")
+		}
+	}
+	fingerprint.InitialTtl = tcpInitialTtl(fingerprint.Ttl)
+
+	if (tcp.ECE || tcp.CWR || tcp.NS) && !contains(fingerprint.Quirks, "ecn") {
+		fingerprint.Quirks = append(fingerprint.Quirks, "ecn")
+	}
+	if tcp.Seq == 0 {
+		fingerprint.Quirks = append(fingerprint.Quirks, "seq-")
+	}
+	if !tcp.ACK && tcp.Ack != 0 {
+		fingerprint.Quirks = append(fingerprint.Quirks, "ack+")
+	}
+	if !tcp.URG && tcp.Urgent != 0 {
+		fingerprint.Quirks = append(fingerprint.Quirks, "uptr+")
+	}
+	if tcp.URG {
+		fingerprint.Quirks = append(fingerprint.Quirks, "urgf+")
+	}
+	if tcp.PSH {
+		fingerprint.Quirks = append(fingerprint.Quirks, "pushf+")
+	}
+
+	bad := false
+	for _, option := range tcp.Options {
+		switch option.OptionType {
+		case layers.TCPOptionKindMSS:
+			if len(option.OptionData) != 2 {
+				bad = true
+				continue
+			}
+			fingerprint.Mss = binary.BigEndian.Uint16(option.OptionData)
+		case layers.TCPOptionKindWindowScale:
+			if len(option.OptionData) != 1 {
+				bad = true
+				continue
+			}
+			fingerprint.Scale = option.OptionData[0]
+			if fingerprint.Scale > 14 {
+				fingerprint.Quirks = append(fingerprint.Quirks, "exws")
+			}
+		case layers.TCPOptionKindTimestamps:
+			if len(option.OptionData) != 8 {
+				bad = true
+				continue
+			}
+			if binary.BigEndian.Uint32(option.OptionData) == 0 {
+				fingerprint.Quirks = append(fingerprint.Quirks, "ts1-")
+			}
+			// There is nothing to echo in a SYN
+			if binary.BigEndian.Uint32(option.OptionData[4:]) != 0 {
+				fingerprint.Quirks = append(fingerprint.Quirks, "ts2+")
+			}
+		case layers.TCPOptionKindSACKPermitted:
+			if len(option.OptionData) != 0 {
+				bad = true
+			}
+		}
+	}
+	for _, padding := range tcp.Padding {
+		if padding != 0 {
+			fingerprint.Quirks = append(fingerprint.Quirks, "opt+")
+			break
+		}
+	}
+	if bad {
+		fingerprint.Quirks = append(fingerprint.Quirks, "bad")
+	}
+
+	fingerprint.Signature = tcpSignature(fingerprint)
+	return fingerprint
+}
+
+// TTLs start at one of a few common values, the closest one above is the likely one
+func tcpInitialTtl(ttl uint8) uint8 {
+	for _, initial := range []uint8{32, 64, 128} {
+		if ttl <= initial {
+			return initial
+		}
+	}
+	return 255
+}
+
+// Kinds of TCP options in the notation of p0f, e.g. "mss,sok,ts,nop,ws"
+func tcpOptionLayout(tcp *layers.TCP) string {
+	kinds := make([]string, 0, len(tcp.Options))
+	for _, option := range tcp.Options {
+		switch option.OptionType {
+		case layers.TCPOptionKindEndList:
+			// Followed by the number of bytes left in the header
+			kinds = append(kinds, "eol+"+strconv.Itoa(len(tcp.Padding)))
+		case layers.TCPOptionKindNop:
+			kinds = append(kinds, "nop")
+		case layers.TCPOptionKindMSS:
+			kinds = append(kinds, "mss")
+		case layers.TCPOptionKindWindowScale:
+			kinds = append(kinds, "ws")
+		case layers.TCPOptionKindSACKPermitted:
+			kinds = append(kinds, "sok")
+		case layers.TCPOptionKindSACK:
+			kinds = append(kinds, "sack")
+		case layers.TCPOptionKindTimestamps:
+			kinds = append(kinds, "ts")
+		default:
+			kinds = append(kinds, "?"+strconv.Itoa(int(option.OptionType)))
+		}
+	}
+	return strings.Join(kinds, ",")
+}
+
+// Raw signature as printed by p0f, e.g. 4:58+6:0:1460:mss*44,7:mss,sok,ts,nop,ws:df,id+:0
+func tcpSignature(fingerprint *db.FlowTcpFingerprint) string {
+	mss := "*"
+	if fingerprint.Mss != 0 {
+		mss = strconv.Itoa(int(fingerprint.Mss))
+	}
+
+	// Windows are often a multiple of the MSS
+	window := strconv.Itoa(int(fingerprint.Window))
+	if fingerprint.Mss != 0 && fingerprint.Window != 0 && fingerprint.Window%fingerprint.Mss == 0 {
+		window = fmt.Sprintf("mss*%d", fingerprint.Window/fingerprint.Mss)
+	}
+
+	payload := "0"
+	if fingerprint.Payload {
+		payload = "+"
+	}
+
+	return fmt.Sprintf("%d:%d+%d:%d:%s:%s,%d:%s:%s:%s",
+		fingerprint.Version,
+		fingerprint.Ttl, fingerprint.InitialTtl-fingerprint.Ttl,
+		fingerprint.IpOptions,
+		mss,
+		window, fingerprint.Scale,
+		fingerprint.Options,
+		strings.Join(fingerprint.Quirks, ","),
+		payload,
+	)
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"go-importer/internal/pkg/db"
+
+	"bytes"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/google/gopacket/reassembly"
+)
+
+// Packet of a crafted capture, sent by the client unless fromServer is set
+type testSegment struct {
+	fromServer bool
+	flags      string
+	seq, ack   uint32
+	payload    string
+}
+
+// Write the segments of connections between 10.0.0.1 and 10.0.0.2:1337 to a pcap,
+// one millisecond apart. The connections follow each other, the client port of the
+// first one is 40000 and increases by one for each of the others.
+func writeTestPcap(t *testing.T, connections ...[]testSegment) []byte {
+	t.Helper()
+	var capture bytes.Buffer
+	writer := pcapgo.NewWriter(&capture)
+	if err := writer.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2024, 11, 30, 13, 0, 0, 0, time.UTC)
+	client, server := net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}
+	i := 0
+	for connection, segments := range connections {
+		port := layers.TCPPort(40000 + connection)
+		for _, segment := range segments {
+			ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: client, DstIP: server}
+			tcp := &layers.TCP{SrcPort: port, DstPort: 1337, Seq: segment.seq, Ack: segment.ack, Window: 64240}
+			if segment.fromServer {
+				ip.SrcIP, ip.DstIP = server, client
+				tcp.SrcPort, tcp.DstPort = tcp.DstPort, tcp.SrcPort
+			}
+			for _, flag := range segment.flags {
+				switch flag {
+				case 'S':
+					tcp.SYN = true
+				case 'A':
+					tcp.ACK = true
+				case 'F':
+					tcp.FIN = true
+				case 'R':
+					tcp.RST = true
+				case 'P':
+					tcp.PSH = true
+				}
+			}
+			tcp.SetNetworkLayerForChecksum(ip)
+
+			buffer := gopacket.NewSerializeBuffer()
+			err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+				&layers.Ethernet{SrcMAC: net.HardwareAddr{2, 0, 0, 0, 0, 1}, DstMAC: net.HardwareAddr{2, 0, 0, 0, 0, 2}, EthernetType: layers.EthernetTypeIPv4},
+				ip, tcp, gopacket.Payload(segment.payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data := buffer.Bytes()
+			info := gopacket.CaptureInfo{Timestamp: start.Add(time.Duration(i) * time.Millisecond), CaptureLength: len(data), Length: len(data)}
+			if err := writer.WritePacket(info, data); err != nil {
+				t.Fatal(err)
+			}
+			i++
+		}
+	}
+	return capture.Bytes()
+}
+
+// Assemble the TCP packets of a pcap the way ProcessPcapHandle does and return the flows
+func assembleTestPcap(t *testing.T, capture []byte) []db.FlowEntry {
+	t.Helper()
+	return assembleTestPcapTimeout(t, capture, 0)
+}
+
+// Same as assembleTestPcap, connections idle for the timeout are closed as timed out
+func assembleTestPcapTimeout(t *testing.T, capture []byte, timeout time.Duration) []db.FlowEntry {
+	t.Helper()
+	reader, err := pcapgo.NewReader(bytes.NewReader(capture))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var flows []db.FlowEntry
+	factory := &TcpStreamFactory{reassemblyCallback: func(entry db.FlowEntry) {
+		flows = append(flows, entry)
+	}, timeout: timeout}
+	assembler := reassembly.NewAssembler(reassembly.NewStreamPool(factory))
+
+	source := gopacket.NewPacketSource(reader, reader.LinkType())
+	for packet := range source.Packets() {
+		network, inner, tunnel := decapsulate(packet)
+		tcp, ok := transportLayer(inner).(*layers.TCP)
+		if network == nil || !ok {
+			t.Fatal("not a TCP packet")
+		}
+		captureInfo := packet.Metadata().CaptureInfo
+		captureInfo.AncillaryData = []interface{}{"test.pcap"}
+		context := &Context{CaptureInfo: captureInfo, Tunnel: tunnel, Network: network}
+		factory.Assemble(assembler, network.NetworkFlow(), tcp, context)
+	}
+	assembler.FlushAll()
+	return flows
+}
+
+// Data of the non-empty items of a flow, prefixed with their direction
+func testFlowData(flow db.FlowEntry) []string {
+	var data []string
+	for _, item := range flow.Flow {
+		if len(item.Data) != 0 {
+			data = append(data, item.From+":"+string(item.Data))
+		}
+	}
+	return data
+}
+
+func checkTestFlows(t *testing.T, flows []db.FlowEntry, expected [][]string, reasons []string) {
+	t.Helper()
+	if len(flows) != len(expected) {
+		for _, flow := range flows {
+			t.Logf("flow %v %v", testFlowData(flow), flow.Tags)
+		}
+		t.Fatalf("got %d flows, expected %d", len(flows), len(expected))
+	}
+	for i, flow := range flows {
+		data := testFlowData(flow)
+		if len(data) != len(expected[i]) {
+			t.Fatalf("flow %d has data %q, expected %q", i, data, expected[i])
+		}
+		for j := range data {
+			if data[j] != expected[i][j] {
+				t.Fatalf("flow %d has data %q, expected %q", i, data, expected[i])
+			}
+		}
+		if flow.Close_reason != reasons[i] {
+			t.Errorf("flow %d was closed by %q, expected %q", i, flow.Close_reason, reasons[i])
+		}
+		if contains(flow.Tags, "gap") {
+			t.Errorf("flow %d has a gap", i)
+		}
+	}
+}
+
+func TestTcpReusedWhileOpen(t *testing.T) {
+	// The client starts a new connection from the same port without closing the first one
+	capture := writeTestPcap(t, []testSegment{
+		{false, "S", 1000, 0, ""},
+		{true, "SA", 5000, 1001, ""},
+		{false, "A", 1001, 5001, ""},
+		{false, "PA", 1001, 5001, "FIRST"},
+		{true, "PA", 5001, 1006, "ONE"},
+		{false, "S", 9000, 0, ""},
+		{true, "SA", 7000, 9001, ""},
+		{false, "A", 9001, 7001, ""},
+		{false, "PA", 9001, 7001, "SECOND"},
+		{true, "PA", 7001, 9007, "TWO"},
+	})
+
+	flows := assembleTestPcap(t, capture)
+	checkTestFlows(t, flows,
+		[][]string{{"c:FIRST", "s:ONE"}, {"c:SECOND", "s:TWO"}},
+		[]string{"reused", "timeout"})
+	if !contains(flows[0].Tags, "reused") {
+		t.Errorf("first flow is not tagged reused: %v", flows[0].Tags)
+	}
+	if !flows[1].Handshake {
+		t.Error("second flow has no handshake")
+	}
+}
+
+func TestTcpReusedInTimeWait(t *testing.T) {
+	// The first connection is closed, the new SYN arrives before its last ACK
+	capture := writeTestPcap(t, []testSegment{
+		{false, "S", 1000, 0, ""},
+		{true, "SA", 5000, 1001, ""},
+		{false, "A", 1001, 5001, ""},
+		{false, "PA", 1001, 5001, "FIRST"},
+		{true, "PA", 5001, 1006, "ONE"},
+		{false, "FA", 1006, 5004, ""},
+		{true, "FA", 5004, 1007, ""},
+		{false, "S", 9000, 0, ""},
+		{true, "SA", 7000, 9001, ""},
+		{false, "A", 9001, 7001, ""},
+		{false, "PA", 9001, 7001, "SECOND"},
+		{true, "PA", 7001, 9007, "TWO"},
+		{false, "FA", 9007, 7004, ""},
+		{true, "FA", 7004, 9008, ""},
+		{false, "A", 9008, 7005, ""},
+	})
+
+	flows := assembleTestPcap(t, capture)
+	checkTestFlows(t, flows,
+		[][]string{{"c:FIRST", "s:ONE"}, {"c:SECOND", "s:TWO"}},
+		[]string{"fin", "fin"})
+}
+
+func TestTcpReusedAfterOneSidedFin(t *testing.T) {
+	// Only the client closed, the server half is still open when the port is reused
+	capture := writeTestPcap(t, []testSegment{
+		{false, "S", 1000, 0, ""},
+		{true, "SA", 5000, 1001, ""},
+		{false, "A", 1001, 5001, ""},
+		{false, "PA", 1001, 5001, "FIRST"},
+		{true, "PA", 5001, 1006, "ONE"},
+		{false, "FA", 1006, 5004, ""},
+		{true, "A", 5004, 1007, ""},
+		{false, "S", 9000, 0, ""},
+		{true, "SA", 7000, 9001, ""},
+		{false, "A", 9001, 7001, ""},
+		{false, "PA", 9001, 7001, "SECOND"},
+		{true, "PA", 7001, 9007, "TWO"},
+	})
+
+	flows := assembleTestPcap(t, capture)
+	checkTestFlows(t, flows,
+		[][]string{{"c:FIRST", "s:ONE"}, {"c:SECOND", "s:TWO"}},
+		[]string{"reused", "timeout"})
+	if !flows[1].Handshake {
+		t.Error("second flow has no handshake")
+	}
+}
+
+func TestTcpReusedAfterReset(t *testing.T) {
+	// The client aborts the first connection and reuses its port right away
+	capture := writeTestPcap(t, []testSegment{
+		{false, "S", 1000, 0, ""},
+		{true, "SA", 5000, 1001, ""},
+		{false, "A", 1001, 5001, ""},
+		{false, "PA", 1001, 5001, "FIRST"},
+		{true, "PA", 5001, 1006, "ONE"},
+		{false, "R", 1006, 0, ""},
+		{false, "S", 9000, 0, ""},
+		{true, "SA", 7000, 9001, ""},
+		{false, "A", 9001, 7001, ""},
+		{false, "PA", 9001, 7001, "SECOND"},
+		{true, "PA", 7001, 9007, "TWO"},
+	})
+
+	flows := assembleTestPcap(t, capture)
+	checkTestFlows(t, flows,
+		[][]string{{"c:FIRST", "s:ONE"}, {"c:SECOND", "s:TWO"}},
+		[]string{"rst", "timeout"})
+	if !flows[1].Handshake {
+		t.Error("second flow has no handshake")
+	}
+}
+
+func TestTcpRetransmittedSyn(t *testing.T) {
+	// A retransmitted SYN keeps its sequence number and does not start a new flow
+	capture := writeTestPcap(t, []testSegment{
+		{false, "S", 1000, 0, ""},
+		{false, "S", 1000, 0, ""},
+		{true, "SA", 5000, 1001, ""},
+		{false, "A", 1001, 5001, ""},
+		{false, "PA", 1001, 5001, "FIRST"},
+		{true, "PA", 5001, 1006, "ONE"},
+	})
+
+	flows := assembleTestPcap(t, capture)
+	checkTestFlows(t, flows,
+		[][]string{{"c:FIRST", "s:ONE"}},
+		[]string{"timeout"})
+}
+
+func TestTcpSegmentsOutOfOrder(t *testing.T) {
+	previous := *segmentTiming
+	*segmentTiming = true
+	defer func() { *segmentTiming = previous }()
+
+	// The second segment arrives first, both are reassembled at once
+	capture := writeTestPcap(t, []testSegment{
+		{false, "S", 1000, 0, ""},
+		{true, "SA", 5000, 1001, ""},
+		{false, "A", 1001, 5001, ""},
+		{false, "PA", 1006, 5001, "WORLD"},
+		{false, "PA", 1001, 5001, "HELLO"},
+		{true, "PA", 5001, 1011, "OK"},
+	})
+
+	flows := assembleTestPcap(t, capture)
+	checkTestFlows(t, flows, [][]string{{"c:HELLOWORLD", "s:OK"}}, []string{"timeout"})
+	// Relative to the item, which starts with the packet that completed the data
+	expected := [][2]int64{{0, 0}, {5, -1000}}
+	segments := flows[0].Flow[0].Meta.Segments
+	if len(segments) != len(expected) || segments[0] != expected[0] || segments[1] != expected[1] {
+		t.Errorf("got segments %v, expected %v", segments, expected)
+	}
+}
+
+func TestTcpFlushedAtEndOfPcap(t *testing.T) {
+	// The first connection is idle long before the end of the pcap, the second one is not
+	capture := writeTestPcap(t, []testSegment{
+		{false, "S", 1000, 0, ""},
+		{true, "SA", 5000, 1001, ""},
+		{false, "A", 1001, 5001, ""},
+		{false, "PA", 1001, 5001, "FIRST"},
+		{true, "PA", 5001, 1006, "ONE"},
+	}, []testSegment{
+		{false, "S", 9000, 0, ""},
+		{true, "SA", 7000, 9001, ""},
+		{false, "A", 9001, 7001, ""},
+		{false, "PA", 9001, 7001, "SECOND"},
+		{true, "PA", 7001, 9007, "TWO"},
+	})
+
+	flows := assembleTestPcapTimeout(t, capture, 3*time.Millisecond)
+	// Flushed in no particular order
+	sort.Slice(flows, func(i, j int) bool {
+		return flows[i].Time.Before(flows[j].Time)
+	})
+	checkTestFlows(t, flows,
+		[][]string{{"c:FIRST", "s:ONE"}, {"c:SECOND", "s:TWO"}},
+		[]string{"timeout", "flushed"})
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"go-importer/internal/pkg/db"
+
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Team map as read from -teams, either a file or a JSON endpoint, e.g.
+//
+//	{
+//		"template": "10.60.{team}.0/24",
+//		"teams": [1, 2, 3, 4],
+//		"ranges": {"5": ["10.61.5.0/24"]},
+//		"own": 3,
+//		"gameserver": ["10.10.0.0/24"]
+//	}
+type TeamConfig struct {
+	// Address or CIDR with {team} replaced by the team id
+	Template string `json:"template"`
+	Teams    []int  `json:"teams"`
+	// Ranges of teams that do not follow the template, by team id
+	Ranges map[string][]string `json:"ranges"`
+	Own    *int                `json:"own"`
+	// Gameserver and checker subnets
+	Gameserver []string `json:"gameserver"`
+}
+
+type teamPrefix struct {
+	prefix netip.Prefix
+	team   int
+}
+
+type TeamMap struct {
+	// Most specific prefix first
+	prefixes   []teamPrefix
+	own        *int
+	gameserver []netip.Prefix
+}
+
+var teamMap atomic.Pointer[TeamMap]
+
+// Addresses without a prefix length are a single host
+func parseTeamPrefix(raw string) (netip.Prefix, error) {
+	if strings.Contains(raw, "/") {
+		prefix, err := netip.ParsePrefix(raw)
+		return prefix.Masked(), err
+	}
+
+	addr, err := netip.ParseAddr(raw)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func NewTeamMap(config TeamConfig) (*TeamMap, error) {
+	teams := &TeamMap{own: config.Own}
+
+	if len(config.Teams) != 0 && !strings.Contains(config.Template, "{team}") {
+		return nil, fmt.Errorf("template %q does not contain {team}", config.Template)
+	}
+	for _, team := range config.Teams {
+		prefix, err := parseTeamPrefix(strings.ReplaceAll(config.Template, "{team}", strconv.Itoa(team)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid template for team %d: %w", team, err)
+		}
+		teams.prefixes = append(teams.prefixes, teamPrefix{prefix, team})
+	}
+
+	for rawTeam, ranges := range config.Ranges {
+		team, err := strconv.Atoi(rawTeam)
+		if err != nil {
+			return nil, fmt.Errorf("invalid team id %q: %w", rawTeam, err)
+		}
+		for _, raw := range ranges {
+			prefix, err := parseTeamPrefix(raw)
+			if err != nil {
+				return nil, fmt.Errorf("invalid range for team %d: %w", team, err)
+			}
+			teams.prefixes = append(teams.prefixes, teamPrefix{prefix, team})
+		}
+	}
+
+	for _, raw := range config.Gameserver {
+		prefix, err := parseTeamPrefix(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gameserver range: %w", err)
+		}
+		teams.gameserver = append(teams.gameserver, prefix)
+	}
+
+	sort.SliceStable(teams.prefixes, func(i, j int) bool {
+		return teams.prefixes[i].prefix.Bits() > teams.prefixes[j].prefix.Bits()
+	})
+	return teams, nil
+}
+
+// Team of an address, false if it does not belong to any team
+func (teams *TeamMap) Lookup(addr netip.Addr) (int, bool) {
+	addr = addr.Unmap()
+	for _, prefix := range teams.prefixes {
+		if prefix.prefix.Contains(addr) {
+			return prefix.team, true
+		}
+	}
+	return 0, false
+}
+
+func (teams *TeamMap) Gameserver(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range teams.gameserver {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Read the team map from a file or an http(s) URL
+func LoadTeamMap(source string) (*TeamMap, error) {
+	var raw []byte
+	var err error
+
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		client := http.Client{Timeout: 10 * time.Second}
+		var response *http.Response
+		response, err = client.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		defer response.Body.Close()
+
+		if response.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status %s", response.Status)
+		}
+		raw, err = io.ReadAll(response.Body)
+	} else {
+		raw, err = os.ReadFile(source)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var config TeamConfig
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, err
+	}
+	return NewTeamMap(config)
+}
+
+// Reload the team map periodically, keeping the old one if that fails
+func WatchTeamMap(source string, interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			teams, err := LoadTeamMap(source)
+			if err != nil {
+				log.Println("Error reloading teams: ", err)
+				continue
+			}
+			teamMap.Store(teams)
+		}
+	}()
+}
+
+// Store the teams of both ends and tag where the flow came from
+func ApplyTeams(flow *db.FlowEntry) {
+	teams := teamMap.Load()
+	if teams == nil {
+		return
+	}
+
+	// The checker may live inside a team range, e.g. next to a NOP team
+	if teams.Gameserver(flow.Src_ip) {
+		flow.Tags = append(flow.Tags, "gameserver")
+	} else if team, ok := teams.Lookup(flow.Src_ip); ok {
+		flow.Team_src = &team
+		flow.Tags = append(flow.Tags, fmt.Sprintf("from-team-%d", team))
+		if teams.own != nil && team == *teams.own {
+			flow.Tags = append(flow.Tags, "own-team")
+		} else {
+			flow.Tags = append(flow.Tags, "enemy")
+		}
+	}
+
+	if team, ok := teams.Lookup(flow.Dst_ip); ok {
+		flow.Team_dst = &team
+	}
+}
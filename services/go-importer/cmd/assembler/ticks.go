@@ -0,0 +1,164 @@
+package main
+
+import (
+	"go-importer/internal/pkg/db"
+
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Tick schedule as read from -ticks, for games with irregular ticks or pauses, e.g.
+//
+//	{
+//		"ticks": [
+//			{"tick": 0, "start": "2024-11-30T13:00:00Z", "length": 180},
+//			{"tick": 60, "start": "2024-11-30T16:30:00Z", "length": 120}
+//		],
+//		"pauses": [{"from": "2024-11-30T15:00:00Z", "to": "2024-11-30T15:15:00Z"}]
+//	}
+type TickConfig struct {
+	// Each segment runs until the next one starts
+	Ticks []TickSegment `json:"ticks"`
+	// The clock stands still during a pause, the tick that was running continues
+	// after it. Flows during a pause have no tick.
+	Pauses []TickPause `json:"pauses"`
+}
+
+type TickSegment struct {
+	// Number of the first tick of the segment
+	Tick  int       `json:"tick"`
+	Start time.Time `json:"start"`
+	// Length of every tick in seconds
+	Length float64 `json:"length"`
+}
+
+type TickPause struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+type TickSchedule struct {
+	// Ordered by start
+	segments []TickSegment
+	pauses   []TickPause
+}
+
+var tickSchedule atomic.Pointer[TickSchedule]
+
+func NewTickSchedule(config TickConfig) (*TickSchedule, error) {
+	schedule := &TickSchedule{
+		segments: append([]TickSegment{}, config.Ticks...),
+		pauses:   append([]TickPause{}, config.Pauses...),
+	}
+
+	for _, segment := range schedule.segments {
+		if segment.Length <= 0 {
+			return nil, fmt.Errorf("tick %d has no length", segment.Tick)
+		}
+	}
+	for _, pause := range schedule.pauses {
+		if !pause.From.Before(pause.To) {
+			return nil, fmt.Errorf("pause from %v ends before it starts", pause.From)
+		}
+	}
+
+	sort.SliceStable(schedule.segments, func(i, j int) bool {
+		return schedule.segments[i].Start.Before(schedule.segments[j].Start)
+	})
+	return schedule, nil
+}
+
+// Schedule with ticks of the same length from the start of the game on
+func NewRegularTickSchedule(start time.Time, length time.Duration) *TickSchedule {
+	return &TickSchedule{
+		segments: []TickSegment{{Tick: 0, Start: start, Length: length.Seconds()}},
+	}
+}
+
+func LoadTickSchedule(path string) (*TickSchedule, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config TickConfig
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, err
+	}
+	return NewTickSchedule(config)
+}
+
+// Reload the schedule periodically, so pauses can be added during the game
+func WatchTickSchedule(path string, interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			schedule, err := LoadTickSchedule(path)
+			if err != nil {
+				log.Println("Error reloading ticks: ", err)
+				continue
+			}
+			tickSchedule.Store(schedule)
+		}
+	}()
+}
+
+// Tick at the given time, false before the game, during a pause or without a schedule
+func (schedule *TickSchedule) Tick(at time.Time) (int, bool) {
+	segment := -1
+	for i := range schedule.segments {
+		if schedule.segments[i].Start.After(at) {
+			break
+		}
+		segment = i
+	}
+	if segment == -1 {
+		return 0, false
+	}
+	start := schedule.segments[segment].Start
+
+	// Only the time the game was running counts
+	elapsed := at.Sub(start)
+	for _, pause := range schedule.pauses {
+		if !at.Before(pause.From) && at.Before(pause.To) {
+			return 0, false
+		}
+
+		from, to := pause.From, pause.To
+		if from.Before(start) {
+			from = start
+		}
+		if to.After(at) {
+			to = at
+		}
+		if from.Before(to) {
+			elapsed -= to.Sub(from)
+		}
+	}
+
+	length := time.Duration(schedule.segments[segment].Length * float64(time.Second))
+	return schedule.segments[segment].Tick + int(elapsed/length), true
+}
+
+// Tick at the given time in the current schedule, nil if there is none
+func tickAt(at time.Time) *int {
+	schedule := tickSchedule.Load()
+	if schedule == nil {
+		return nil
+	}
+
+	tick, ok := schedule.Tick(at)
+	if !ok {
+		return nil
+	}
+	return &tick
+}
+
+// Store the tick in which a flow started
+func ApplyTick(flow *db.FlowEntry) {
+	flow.Tick = tickAt(flow.Time)
+}
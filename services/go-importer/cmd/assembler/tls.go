@@ -0,0 +1,864 @@
+package main
+
+import (
+	"go-importer/internal/pkg/db"
+
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	tlsRecordChangeCipherSpec = 20
+	tlsRecordHandshake        = 22
+	tlsRecordApplicationData  = 23
+
+	tlsHandshakeClientHello       = 1
+	tlsHandshakeServerHello       = 2
+	tlsHandshakeClientKeyExchange = 16
+	tlsHandshakeFinished          = 20
+	tlsHandshakeKeyUpdate         = 24
+
+	tlsVersion12 = 0x0303
+	tlsVersion13 = 0x0304
+
+	// Largest record allowed by RFC 5246, ciphertext expansion included
+	tlsMaxRecord = 16384 + 2048
+)
+
+// ServerHello random of a HelloRetryRequest, see RFC 8446 section 4.1.3
+var tlsHelloRetryRandom, _ = hex.DecodeString("cf21ad74e59a6111be1d8c021e65b891c2a211167abb8c5e079e09e2c8a8339c")
+
+/*
+ * Keys
+ */
+
+// Secrets from an NSS key log file (SSLKEYLOGFILE), reloaded when the file grows
+type TlsKeyLog struct {
+	path   string
+	offset int64
+
+	mutex sync.RWMutex
+	// "<label> <client random>" -> secret
+	secrets map[string][]byte
+}
+
+var tlsKeyLog *TlsKeyLog
+var tlsRsaKeys []*rsa.PrivateKey
+
+func NewTlsKeyLog(path string) (*TlsKeyLog, error) {
+	keyLog := &TlsKeyLog{
+		path:    filepath.Clean(path),
+		secrets: make(map[string][]byte),
+	}
+	if err := keyLog.Load(); err != nil {
+		return nil, err
+	}
+	return keyLog, nil
+}
+
+// Read the lines added since the last load
+func (keyLog *TlsKeyLog) Load() error {
+	file, err := os.Open(keyLog.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	// The file was truncated or replaced, old secrets are kept around
+	if stat.Size() < keyLog.offset {
+		keyLog.offset = 0
+	}
+
+	if _, err := file.Seek(keyLog.offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(file)
+	count := 0
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			// Partially written line, try again on the next write
+			break
+		}
+		keyLog.offset += int64(len(line))
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		secret, err := hex.DecodeString(fields[2])
+		if err != nil {
+			continue
+		}
+
+		keyLog.mutex.Lock()
+		keyLog.secrets[fields[0]+" "+strings.ToLower(fields[1])] = secret
+		keyLog.mutex.Unlock()
+		count++
+	}
+
+	if count != 0 {
+		log.Printf("Loaded %d TLS secrets from %s\n", count, keyLog.path)
+	}
+	return nil
+}
+
+// Reload the key log whenever it changes
+func (keyLog *TlsKeyLog) Watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != keyLog.path {
+					continue
+				}
+				if event.Op&fsnotify.Create != 0 {
+					keyLog.offset = 0
+				}
+				if event.Op&(fsnotify.Create|fsnotify.Write) != 0 {
+					if err := keyLog.Load(); err != nil {
+						log.Println("Error loading TLS key log: ", err)
+					}
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Println("watcher error:", err)
+			}
+		}
+	}()
+
+	// Watch the directory, so we also notice the file being replaced
+	return watcher.Add(filepath.Dir(keyLog.path))
+}
+
+func (keyLog *TlsKeyLog) Secret(label string, key []byte) []byte {
+	if keyLog == nil {
+		return nil
+	}
+
+	keyLog.mutex.RLock()
+	defer keyLog.mutex.RUnlock()
+	return keyLog.secrets[label+" "+hex.EncodeToString(key)]
+}
+
+// Load RSA private keys from a comma separated list of PEM files
+func LoadTlsRsaKeys(raw string) error {
+	for _, path := range strings.Split(raw, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		found := false
+		for {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil {
+				break
+			}
+
+			switch block.Type {
+			case "RSA PRIVATE KEY":
+				key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+				if err != nil {
+					return err
+				}
+				tlsRsaKeys = append(tlsRsaKeys, key)
+				found = true
+			case "PRIVATE KEY":
+				key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+				if err != nil {
+					return err
+				}
+				if key, ok := key.(*rsa.PrivateKey); ok {
+					tlsRsaKeys = append(tlsRsaKeys, key)
+					found = true
+				}
+			}
+		}
+
+		if !found {
+			return errors.New("no RSA private key in " + path)
+		}
+	}
+	return nil
+}
+
+/*
+ * Cipher suites
+ */
+
+const (
+	tlsCipherGcm = iota
+	tlsCipherChacha
+	tlsCipherCbc
+)
+
+type tlsSuite struct {
+	cipher int
+	keyLen int
+	// Length of the IV taken from the key block (TLS 1.2) or derived from the secret (TLS 1.3)
+	ivLen int
+	mac   func() hash.Hash
+	// Hash of the PRF (TLS 1.2) or HKDF (TLS 1.3)
+	hash func() hash.Hash
+}
+
+var tlsSuites = map[uint16]tlsSuite{
+	// TLS 1.3
+	0x1301: {tlsCipherGcm, 16, 12, nil, sha256.New},
+	0x1302: {tlsCipherGcm, 32, 12, nil, sha512.New384},
+	0x1303: {tlsCipherChacha, 32, 12, nil, sha256.New},
+
+	// TLS 1.2 AEAD
+	0x009c: {tlsCipherGcm, 16, 4, nil, sha256.New},
+	0x009e: {tlsCipherGcm, 16, 4, nil, sha256.New},
+	0xc02b: {tlsCipherGcm, 16, 4, nil, sha256.New},
+	0xc02f: {tlsCipherGcm, 16, 4, nil, sha256.New},
+	0x009d: {tlsCipherGcm, 32, 4, nil, sha512.New384},
+	0x009f: {tlsCipherGcm, 32, 4, nil, sha512.New384},
+	0xc02c: {tlsCipherGcm, 32, 4, nil, sha512.New384},
+	0xc030: {tlsCipherGcm, 32, 4, nil, sha512.New384},
+	0xcca8: {tlsCipherChacha, 32, 12, nil, sha256.New},
+	0xcca9: {tlsCipherChacha, 32, 12, nil, sha256.New},
+	0xccaa: {tlsCipherChacha, 32, 12, nil, sha256.New},
+
+	// TLS 1.2 CBC
+	0x002f: {tlsCipherCbc, 16, 16, sha1.New, sha256.New},
+	0x0035: {tlsCipherCbc, 32, 16, sha1.New, sha256.New},
+	0x003c: {tlsCipherCbc, 16, 16, sha256.New, sha256.New},
+	0x003d: {tlsCipherCbc, 32, 16, sha256.New, sha256.New},
+	0xc009: {tlsCipherCbc, 16, 16, sha1.New, sha256.New},
+	0xc00a: {tlsCipherCbc, 32, 16, sha1.New, sha256.New},
+	0xc013: {tlsCipherCbc, 16, 16, sha1.New, sha256.New},
+	0xc014: {tlsCipherCbc, 32, 16, sha1.New, sha256.New},
+	0xc023: {tlsCipherCbc, 16, 16, sha256.New, sha256.New},
+	0xc024: {tlsCipherCbc, 32, 16, sha512.New384, sha512.New384},
+	0xc027: {tlsCipherCbc, 16, 16, sha256.New, sha256.New},
+	0xc028: {tlsCipherCbc, 32, 16, sha512.New384, sha512.New384},
+}
+
+func (suite *tlsSuite) macLen() int {
+	if suite.mac == nil {
+		return 0
+	}
+	return suite.mac().Size()
+}
+
+// P_hash from RFC 5246 section 5
+func tls12Prf(hash func() hash.Hash, secret []byte, label string, seed []byte, length int) []byte {
+	seed = append([]byte(label), seed...)
+	out := make([]byte, 0, length)
+
+	mac := hmac.New(hash, secret)
+	mac.Write(seed)
+	a := mac.Sum(nil)
+	for len(out) < length {
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(seed)
+		out = mac.Sum(out)
+
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+	}
+	return out[:length]
+}
+
+// HKDF-Expand-Label from RFC 8446 section 7.1, always with an empty context
+func tls13ExpandLabel(hash func() hash.Hash, secret []byte, label string, length int) []byte {
+	label = "tls13 " + label
+	info := []byte{byte(length >> 8), byte(length), byte(len(label))}
+	info = append(info, label...)
+	info = append(info, 0)
+
+	out := make([]byte, length)
+	io.ReadFull(hkdf.Expand(hash, secret, info), out)
+	return out
+}
+
+/*
+ * Records
+ */
+
+type tlsRecord struct {
+	// Flow item in which the record ends
+	item    int
+	header  []byte
+	payload []byte
+}
+
+func (record *tlsRecord) contentType() byte {
+	return record.header[0]
+}
+
+// Split the data of one direction into records, stops at the first gap or non-TLS data
+func tlsRecords(flow *db.FlowEntry, from string) []tlsRecord {
+	records := []tlsRecord{}
+	buffer := []byte{}
+
+	for i, item := range flow.Flow {
+		if item.Kind != "raw" || item.From != from {
+			continue
+		}
+		if item.Meta.Gap != nil {
+			break
+		}
+
+		buffer = append(buffer, item.Data...)
+		for len(buffer) >= 5 {
+			length := int(binary.BigEndian.Uint16(buffer[3:5]))
+			if buffer[0] < tlsRecordChangeCipherSpec || buffer[0] > 24 || buffer[1] != 3 || length > tlsMaxRecord {
+				return records
+			}
+			if len(buffer) < 5+length {
+				break
+			}
+
+			records = append(records, tlsRecord{i, buffer[:5], buffer[5 : 5+length]})
+			buffer = buffer[5+length:]
+		}
+	}
+
+	return records
+}
+
+// Reassembles handshake messages spread over multiple records
+type tlsHandshakeReader struct {
+	buffer []byte
+}
+
+// Push the content of a handshake record, returns the completed messages including their header
+func (r *tlsHandshakeReader) Push(data []byte) [][]byte {
+	r.buffer = append(r.buffer, data...)
+
+	messages := [][]byte{}
+	for len(r.buffer) >= 4 {
+		length := int(r.buffer[1])<<16 | int(r.buffer[2])<<8 | int(r.buffer[3])
+		if len(r.buffer) < 4+length {
+			break
+		}
+		messages = append(messages, r.buffer[:4+length])
+		r.buffer = r.buffer[4+length:]
+	}
+	return messages
+}
+
+// Handshake messages sent before encryption starts
+func tlsPlainHandshake(records []tlsRecord) [][]byte {
+	reader := tlsHandshakeReader{}
+	messages := [][]byte{}
+	for _, record := range records {
+		if record.contentType() == tlsRecordChangeCipherSpec || record.contentType() == tlsRecordApplicationData {
+			break
+		}
+		if record.contentType() == tlsRecordHandshake {
+			messages = append(messages, reader.Push(record.payload)...)
+		}
+	}
+	return messages
+}
+
+// Cursor over the fields of a handshake message, reads nothing after the first error
+type tlsReader struct {
+	data []byte
+	err  bool
+}
+
+func (r *tlsReader) bytes(n int) []byte {
+	if r.err || len(r.data) < n {
+		r.err = true
+		return nil
+	}
+	out := r.data[:n]
+	r.data = r.data[n:]
+	return out
+}
+
+func (r *tlsReader) uint(n int) int {
+	value := 0
+	for _, b := range r.bytes(n) {
+		value = value<<8 | int(b)
+	}
+	return value
+}
+
+// Vector prefixed with an n byte length
+func (r *tlsReader) vector(n int) []byte {
+	return r.bytes(r.uint(n))
+}
+
+/*
+ * Sessions
+ */
+
+type tlsSession struct {
+	version      uint16
+	suiteId      uint16
+	suite        tlsSuite
+	clientRandom []byte
+	serverRandom []byte
+	// Extended master secret (RFC 7627) and encrypt-then-MAC (RFC 7366)
+	ems bool
+	etm bool
+
+	// RSA key exchange, with the handshake messages up to it for the extended master secret
+	encryptedPremaster []byte
+	transcript         []byte
+}
+
+// Session keys can be derived for, nil if the handshake is incomplete or uses something we do not support
+func newTlsSession(handshake *tlsHandshake) *tlsSession {
+	client, server := handshake.client, handshake.server
+	if client == nil || server == nil {
+		return nil
+	}
+
+	session := &tlsSession{
+		version:      server.negotiatedVersion(),
+		suiteId:      server.cipher,
+		clientRandom: client.random,
+		serverRandom: server.random,
+		ems:          server.ems,
+		etm:          server.etm,
+	}
+
+	suite, ok := tlsSuites[session.suiteId]
+	if !ok || (session.version != tlsVersion12 && session.version != tlsVersion13) {
+		return nil
+	}
+	session.suite = suite
+
+	// Transcript for the extended master secret, the server flight happens between ClientHello and ClientKeyExchange
+	clientMessages := handshake.clientMessages
+	if session.version == tlsVersion12 && len(clientMessages) != 0 {
+		session.transcript = append(session.transcript, clientMessages[0]...)
+		for _, message := range handshake.serverMessages {
+			session.transcript = append(session.transcript, message...)
+		}
+		for _, message := range clientMessages[1:] {
+			session.transcript = append(session.transcript, message...)
+			if message[0] == tlsHandshakeClientKeyExchange {
+				r := tlsReader{data: message[4:]}
+				session.encryptedPremaster = r.vector(2)
+				break
+			}
+		}
+	}
+
+	return session
+}
+
+// Master secret of a TLS 1.2 session, either from the key log or the RSA key exchange
+func (session *tlsSession) masterSecret() []byte {
+	if master := tlsKeyLog.Secret("CLIENT_RANDOM", session.clientRandom); master != nil {
+		return master
+	}
+
+	if len(session.encryptedPremaster) < 8 {
+		return nil
+	}
+
+	premaster := tlsKeyLog.Secret("RSA", session.encryptedPremaster[:8])
+	for _, key := range tlsRsaKeys {
+		if premaster != nil {
+			break
+		}
+		if key.Size() != len(session.encryptedPremaster) {
+			continue
+		}
+		decrypted, err := rsa.DecryptPKCS1v15(nil, key, session.encryptedPremaster)
+		if err == nil && len(decrypted) == 48 {
+			premaster = decrypted
+		}
+	}
+	if premaster == nil {
+		return nil
+	}
+
+	if session.ems {
+		transcript := session.suite.hash()
+		transcript.Write(session.transcript)
+		return tls12Prf(session.suite.hash, premaster, "extended master secret", transcript.Sum(nil), 48)
+	}
+
+	seed := append(append([]byte{}, session.clientRandom...), session.serverRandom...)
+	return tls12Prf(session.suite.hash, premaster, "master secret", seed, 48)
+}
+
+// Record decryption for one direction
+type tlsDecrypter struct {
+	session *tlsSession
+	aead    cipher.AEAD
+	block   cipher.Block
+	iv      []byte
+	macLen  int
+	seq     uint64
+	// Current traffic secret, TLS 1.3 only
+	secret []byte
+}
+
+func (session *tlsSession) newDecrypter(key []byte, iv []byte) (*tlsDecrypter, error) {
+	decrypter := &tlsDecrypter{session: session, iv: iv, macLen: session.suite.macLen()}
+
+	var err error
+	switch session.suite.cipher {
+	case tlsCipherGcm:
+		var block cipher.Block
+		if block, err = aes.NewCipher(key); err == nil {
+			decrypter.aead, err = cipher.NewGCM(block)
+		}
+	case tlsCipherChacha:
+		decrypter.aead, err = chacha20poly1305.New(key)
+	case tlsCipherCbc:
+		decrypter.block, err = aes.NewCipher(key)
+	}
+	return decrypter, err
+}
+
+// Keys for one direction of a TLS 1.2 session from its key block
+func (session *tlsSession) newDecrypter12(master []byte, client bool) (*tlsDecrypter, error) {
+	suite := session.suite
+	macLen := suite.macLen()
+
+	seed := append(append([]byte{}, session.serverRandom...), session.clientRandom...)
+	keyBlock := tls12Prf(suite.hash, master, "key expansion", seed, 2*(macLen+suite.keyLen+suite.ivLen))
+
+	// client mac, server mac, client key, server key, client iv, server iv
+	keyBlock = keyBlock[2*macLen:]
+	key, iv := keyBlock[suite.keyLen:2*suite.keyLen], keyBlock[2*suite.keyLen+suite.ivLen:]
+	if client {
+		key, iv = keyBlock[:suite.keyLen], keyBlock[2*suite.keyLen:2*suite.keyLen+suite.ivLen]
+	}
+	return session.newDecrypter(key, iv)
+}
+
+// Keys for one direction of a TLS 1.3 session from a traffic secret
+func (session *tlsSession) newDecrypter13(secret []byte) (*tlsDecrypter, error) {
+	suite := session.suite
+	key := tls13ExpandLabel(suite.hash, secret, "key", suite.keyLen)
+	iv := tls13ExpandLabel(suite.hash, secret, "iv", suite.ivLen)
+
+	decrypter, err := session.newDecrypter(key, iv)
+	if decrypter != nil {
+		decrypter.secret = secret
+	}
+	return decrypter, err
+}
+
+// Keys after a TLS 1.3 KeyUpdate
+func (d *tlsDecrypter) update() (*tlsDecrypter, error) {
+	hash := d.session.suite.hash
+	return d.session.newDecrypter13(tls13ExpandLabel(hash, d.secret, "traffic upd", hash().Size()))
+}
+
+// IV xored with the sequence number
+func (d *tlsDecrypter) nonce() []byte {
+	nonce := append([]byte{}, d.iv...)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(d.seq >> (8 * i))
+	}
+	return nonce
+}
+
+// Returns the content type and plaintext of a record.
+// The sequence number only advances for records we could decrypt.
+func (d *tlsDecrypter) open(record tlsRecord) (byte, []byte, error) {
+	contentType := record.contentType()
+	payload := record.payload
+	var plaintext []byte
+	var err error
+
+	if d.session.version == tlsVersion13 {
+		plaintext, err = d.aead.Open(nil, d.nonce(), payload, record.header)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		// The real content type follows the plaintext, padded with zeros
+		end := len(plaintext) - 1
+		for end >= 0 && plaintext[end] == 0 {
+			end--
+		}
+		if end < 0 {
+			return 0, nil, errors.New("record without content type")
+		}
+		contentType, plaintext = plaintext[end], plaintext[:end]
+	} else if d.aead != nil {
+		// GCM sends the second part of the nonce with every record
+		var nonce []byte
+		if d.session.suite.cipher == tlsCipherGcm {
+			if len(payload) < 8 {
+				return 0, nil, errors.New("record too short")
+			}
+			nonce = append(append([]byte{}, d.iv...), payload[:8]...)
+			payload = payload[8:]
+		} else {
+			nonce = d.nonce()
+		}
+
+		length := len(payload) - d.aead.Overhead()
+		if length < 0 {
+			return 0, nil, errors.New("record too short")
+		}
+		plaintext, err = d.aead.Open(nil, nonce, payload, d.additionalData(contentType, length))
+		if err != nil {
+			return 0, nil, err
+		}
+	} else {
+		// Explicit IV, encrypted data and, with encrypt-then-MAC, the MAC after it
+		if d.session.etm {
+			if len(payload) < d.macLen {
+				return 0, nil, errors.New("record too short")
+			}
+			payload = payload[:len(payload)-d.macLen]
+		}
+		if len(payload) < 2*aes.BlockSize || len(payload)%aes.BlockSize != 0 {
+			return 0, nil, errors.New("invalid record length")
+		}
+
+		plaintext = make([]byte, len(payload)-aes.BlockSize)
+		cipher.NewCBCDecrypter(d.block, payload[:aes.BlockSize]).CryptBlocks(plaintext, payload[aes.BlockSize:])
+
+		padding := int(plaintext[len(plaintext)-1]) + 1
+		macLen := d.macLen
+		if d.session.etm {
+			macLen = 0
+		}
+		if padding+macLen > len(plaintext) {
+			return 0, nil, errors.New("invalid padding")
+		}
+		plaintext = plaintext[:len(plaintext)-padding-macLen]
+	}
+
+	d.seq++
+	return contentType, plaintext, nil
+}
+
+// Additional data of TLS 1.2 AEAD records
+func (d *tlsDecrypter) additionalData(contentType byte, length int) []byte {
+	data := make([]byte, 13)
+	binary.BigEndian.PutUint64(data, d.seq)
+	data[8] = contentType
+	binary.BigEndian.PutUint16(data[9:], tlsVersion12)
+	binary.BigEndian.PutUint16(data[11:], uint16(length))
+	return data
+}
+
+type tlsPlaintext struct {
+	item int
+	data []byte
+}
+
+// Application data of one direction
+func (session *tlsSession) decrypt(records []tlsRecord, client bool) []tlsPlaintext {
+	if session.version == tlsVersion13 {
+		return session.decrypt13(records, client)
+	}
+
+	master := session.masterSecret()
+	if master == nil {
+		return nil
+	}
+
+	plaintexts := []tlsPlaintext{}
+	var decrypter *tlsDecrypter
+	for _, record := range records {
+		if record.contentType() == tlsRecordChangeCipherSpec {
+			var err error
+			if decrypter, err = session.newDecrypter12(master, client); err != nil {
+				return plaintexts
+			}
+			continue
+		}
+		if decrypter == nil {
+			continue
+		}
+
+		contentType, plaintext, err := decrypter.open(record)
+		if err == nil && contentType == tlsRecordApplicationData {
+			plaintexts = append(plaintexts, tlsPlaintext{record.item, plaintext})
+		}
+	}
+	return plaintexts
+}
+
+func (session *tlsSession) decrypt13(records []tlsRecord, client bool) []tlsPlaintext {
+	prefix := "SERVER_"
+	if client {
+		prefix = "CLIENT_"
+	}
+	handshakeSecret := tlsKeyLog.Secret(prefix+"HANDSHAKE_TRAFFIC_SECRET", session.clientRandom)
+	trafficSecret := tlsKeyLog.Secret(prefix+"TRAFFIC_SECRET_0", session.clientRandom)
+
+	// Encrypted records use the handshake keys until the Finished message
+	application := handshakeSecret == nil
+	secret := handshakeSecret
+	if application {
+		secret = trafficSecret
+	}
+	if secret == nil {
+		return nil
+	}
+
+	decrypter, err := session.newDecrypter13(secret)
+	if err != nil {
+		return nil
+	}
+
+	plaintexts := []tlsPlaintext{}
+	handshake := tlsHandshakeReader{}
+	for _, record := range records {
+		if record.contentType() != tlsRecordApplicationData {
+			continue
+		}
+
+		contentType, plaintext, err := decrypter.open(record)
+		if err != nil && !application && trafficSecret != nil {
+			// Finished got lost somewhere, the traffic keys might still work
+			if next, nextErr := session.newDecrypter13(trafficSecret); nextErr == nil {
+				decrypter, application = next, true
+				contentType, plaintext, err = decrypter.open(record)
+			}
+		}
+		if err != nil {
+			continue
+		}
+
+		switch contentType {
+		case tlsRecordHandshake:
+			for _, message := range handshake.Push(plaintext) {
+				var next *tlsDecrypter
+				if message[0] == tlsHandshakeFinished && !application && trafficSecret != nil {
+					next, err = session.newDecrypter13(trafficSecret)
+					application = true
+				} else if message[0] == tlsHandshakeKeyUpdate && application {
+					next, err = decrypter.update()
+				}
+				if err != nil {
+					return plaintexts
+				}
+				if next != nil {
+					decrypter = next
+				}
+			}
+		case tlsRecordApplicationData:
+			plaintexts = append(plaintexts, tlsPlaintext{record.item, plaintext})
+		}
+	}
+	return plaintexts
+}
+
+// Parse the TLS handshake of a flow into its metadata, and decrypt it with the configured key log or RSA keys.
+// The plaintext is added as "tls" items, one per raw item it was received in, the parsers
+// of the application protocols read those instead of the raw items (see flowDataKind).
+func ParseTlsFlow(flow *db.FlowEntry) {
+	client := tlsRecords(flow, "c")
+	server := tlsRecords(flow, "s")
+	handshake := parseTlsHandshake(client, server)
+	if handshake == nil {
+		return
+	}
+
+	flow.Tls = handshake.Metadata()
+	if !contains(flow.Tags, "tls") {
+		flow.Tags = append(flow.Tags, "tls")
+	}
+	if tlsClients.Unusual(int(flow.Dst_port), flow.Tls) && !contains(flow.Tags, "tls-unusual") {
+		flow.Tags = append(flow.Tags, "tls-unusual")
+	}
+
+	if tlsKeyLog == nil && len(tlsRsaKeys) == 0 {
+		return
+	}
+	session := newTlsSession(handshake)
+	if session == nil {
+		return
+	}
+
+	plaintexts := append(session.decrypt(client, true), session.decrypt(server, false)...)
+	if len(plaintexts) == 0 {
+		return
+	}
+
+	// Raw items alternate between the directions, so this keeps the conversation in order
+	sort.SliceStable(plaintexts, func(i, j int) bool {
+		return plaintexts[i].item < plaintexts[j].item
+	})
+
+	items := []db.FlowItem{}
+	last := -1
+	for _, plaintext := range plaintexts {
+		if plaintext.item == last {
+			items[len(items)-1].Data = append(items[len(items)-1].Data, plaintext.data...)
+			continue
+		}
+
+		source := flow.Flow[plaintext.item]
+		items = append(items, db.FlowItem{
+			Kind: "tls",
+			From: source.From,
+			Data: append([]byte{}, plaintext.data...),
+			Time: source.Time,
+		})
+		last = plaintext.item
+	}
+
+	if appendFlowItems(flow, items) > 0 && !contains(flow.Tags, "tls-decrypted") {
+		flow.Tags = append(flow.Tags, "tls-decrypted")
+	}
+}
+
+// Kind of the items that hold the application data of a flow: the plaintext of a
+// decrypted TLS flow, the raw data otherwise
+func flowDataKind(flow *db.FlowEntry) string {
+	if contains(flow.Tags, "tls-decrypted") {
+		return "tls"
+	}
+	return "raw"
+}
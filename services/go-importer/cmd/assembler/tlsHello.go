@@ -0,0 +1,444 @@
+package main
+
+import (
+	"go-importer/internal/pkg/db"
+
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	tlsExtensionServerName          = 0x0000
+	tlsExtensionSupportedGroups     = 0x000a
+	tlsExtensionPointFormats        = 0x000b
+	tlsExtensionSignatureAlgorithms = 0x000d
+	tlsExtensionAlpn                = 0x0010
+	tlsExtensionEncryptThenMac      = 0x0016
+	tlsExtensionExtendedMaster      = 0x0017
+	tlsExtensionSupportedVersions   = 0x002b
+)
+
+type tlsClientHello struct {
+	version    uint16
+	random     []byte
+	ciphers    []uint16
+	extensions []uint16
+	sni        string
+	alpn       []string
+	// supported_versions, empty for clients older than TLS 1.3
+	versions            []uint16
+	groups              []uint16
+	pointFormats        []uint8
+	signatureAlgorithms []uint16
+}
+
+type tlsServerHello struct {
+	version    uint16
+	random     []byte
+	cipher     uint16
+	extensions []uint16
+	alpn       string
+	// supported_versions, 0 below TLS 1.3
+	selectedVersion uint16
+	// Extended master secret (RFC 7627) and encrypt-then-MAC (RFC 7366)
+	ems bool
+	etm bool
+}
+
+func (hello *tlsServerHello) negotiatedVersion() uint16 {
+	if hello.selectedVersion != 0 {
+		return hello.selectedVersion
+	}
+	return hello.version
+}
+
+// Plaintext handshake of both directions
+type tlsHandshake struct {
+	client         *tlsClientHello
+	server         *tlsServerHello
+	clientMessages [][]byte
+	serverMessages [][]byte
+}
+
+// Parse the handshake messages sent before encryption, nil if the flow does not start with a ClientHello
+func parseTlsHandshake(client []tlsRecord, server []tlsRecord) *tlsHandshake {
+	if len(client) == 0 || client[0].contentType() != tlsRecordHandshake {
+		return nil
+	}
+
+	handshake := &tlsHandshake{
+		clientMessages: tlsPlainHandshake(client),
+		serverMessages: tlsPlainHandshake(server),
+	}
+
+	for _, message := range handshake.clientMessages {
+		if message[0] == tlsHandshakeClientHello {
+			handshake.client = parseTlsClientHello(message[4:])
+			break
+		}
+	}
+	if handshake.client == nil {
+		return nil
+	}
+
+	for _, message := range handshake.serverMessages {
+		if message[0] != tlsHandshakeServerHello {
+			continue
+		}
+
+		// The client will send a second ClientHello, the ServerHello we care about follows after that
+		hello := parseTlsServerHello(message[4:])
+		if hello != nil && !bytes.Equal(hello.random, tlsHelloRetryRandom) {
+			handshake.server = hello
+			break
+		}
+	}
+
+	return handshake
+}
+
+func parseTlsClientHello(data []byte) *tlsClientHello {
+	r := tlsReader{data: data}
+	hello := &tlsClientHello{}
+
+	hello.version = uint16(r.uint(2))
+	hello.random = r.bytes(32)
+	r.vector(1)
+	hello.ciphers = tlsUint16s(r.vector(2))
+	r.vector(1)
+	if r.err {
+		return nil
+	}
+
+	// Extensions are optional
+	extensions := tlsReader{data: r.vector(2)}
+	for !extensions.err && len(extensions.data) != 0 {
+		extension := uint16(extensions.uint(2))
+		data := tlsReader{data: extensions.vector(2)}
+		hello.extensions = append(hello.extensions, extension)
+
+		switch extension {
+		case tlsExtensionServerName:
+			names := tlsReader{data: data.vector(2)}
+			for !names.err && len(names.data) != 0 {
+				nameType := names.uint(1)
+				name := names.vector(2)
+				if nameType == 0 {
+					hello.sni = string(name)
+				}
+			}
+		case tlsExtensionAlpn:
+			protocols := tlsReader{data: data.vector(2)}
+			for !protocols.err && len(protocols.data) != 0 {
+				if protocol := protocols.vector(1); protocol != nil {
+					hello.alpn = append(hello.alpn, string(protocol))
+				}
+			}
+		case tlsExtensionSupportedVersions:
+			hello.versions = tlsUint16s(data.vector(1))
+		case tlsExtensionSupportedGroups:
+			hello.groups = tlsUint16s(data.vector(2))
+		case tlsExtensionPointFormats:
+			hello.pointFormats = data.vector(1)
+		case tlsExtensionSignatureAlgorithms:
+			hello.signatureAlgorithms = tlsUint16s(data.vector(2))
+		}
+	}
+
+	return hello
+}
+
+func parseTlsServerHello(data []byte) *tlsServerHello {
+	r := tlsReader{data: data}
+	hello := &tlsServerHello{}
+
+	hello.version = uint16(r.uint(2))
+	hello.random = r.bytes(32)
+	r.vector(1)
+	hello.cipher = uint16(r.uint(2))
+	r.bytes(1)
+	if r.err {
+		return nil
+	}
+
+	extensions := tlsReader{data: r.vector(2)}
+	for !extensions.err && len(extensions.data) != 0 {
+		extension := uint16(extensions.uint(2))
+		data := tlsReader{data: extensions.vector(2)}
+		hello.extensions = append(hello.extensions, extension)
+
+		switch extension {
+		case tlsExtensionAlpn:
+			protocols := tlsReader{data: data.vector(2)}
+			hello.alpn = string(protocols.vector(1))
+		case tlsExtensionSupportedVersions:
+			hello.selectedVersion = uint16(data.uint(2))
+		case tlsExtensionEncryptThenMac:
+			hello.etm = true
+		case tlsExtensionExtendedMaster:
+			hello.ems = true
+		}
+	}
+
+	return hello
+}
+
+func tlsUint16s(data []byte) []uint16 {
+	values := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		values = append(values, uint16(data[i])<<8|uint16(data[i+1]))
+	}
+	return values
+}
+
+// GREASE values (RFC 8701) are random, fingerprints have to ignore them
+func tlsGrease(value uint16) bool {
+	return value&0x0f0f == 0x0a0a && value>>8 == value&0xff
+}
+
+func tlsWithoutGrease(values []uint16) []uint16 {
+	out := []uint16{}
+	for _, value := range values {
+		if !tlsGrease(value) {
+			out = append(out, value)
+		}
+	}
+	return out
+}
+
+/*
+ * Metadata
+ */
+
+func (handshake *tlsHandshake) Metadata() *db.FlowTls {
+	client := handshake.client
+	metadata := &db.FlowTls{
+		Sni:  client.sni,
+		Alpn: client.alpn,
+		Ja3:  client.ja3(),
+		Ja4:  client.ja4(),
+	}
+
+	versions := tlsWithoutGrease(client.versions)
+	if len(versions) == 0 {
+		versions = []uint16{client.version}
+	}
+	for _, version := range versions {
+		metadata.Versions = append(metadata.Versions, tls.VersionName(version))
+	}
+	for _, cipher := range tlsWithoutGrease(client.ciphers) {
+		metadata.Ciphers = append(metadata.Ciphers, tls.CipherSuiteName(cipher))
+	}
+
+	if server := handshake.server; server != nil {
+		metadata.AlpnSelected = server.alpn
+		metadata.Version = tls.VersionName(server.negotiatedVersion())
+		metadata.Cipher = tls.CipherSuiteName(server.cipher)
+		metadata.Ja3s = server.ja3s()
+		metadata.Ja4s = server.ja4s()
+	}
+
+	return metadata
+}
+
+// Decimal values joined by "-", see https://github.com/salesforce/ja3
+func ja3List[T uint8 | uint16](values []T) string {
+	parts := make([]string, len(values))
+	for i, value := range values {
+		parts[i] = strconv.Itoa(int(value))
+	}
+	return strings.Join(parts, "-")
+}
+
+func ja3Hash(fields ...string) string {
+	sum := md5.Sum([]byte(strings.Join(fields, ",")))
+	return hex.EncodeToString(sum[:])
+}
+
+func (hello *tlsClientHello) ja3() string {
+	return ja3Hash(
+		strconv.Itoa(int(hello.version)),
+		ja3List(tlsWithoutGrease(hello.ciphers)),
+		ja3List(tlsWithoutGrease(hello.extensions)),
+		ja3List(tlsWithoutGrease(hello.groups)),
+		ja3List(hello.pointFormats),
+	)
+}
+
+func (hello *tlsServerHello) ja3s() string {
+	return ja3Hash(
+		strconv.Itoa(int(hello.version)),
+		strconv.Itoa(int(hello.cipher)),
+		ja3List(tlsWithoutGrease(hello.extensions)),
+	)
+}
+
+// See https://github.com/FoxIO-LLC/ja4/blob/main/technical_details/JA4.md
+func ja4Version(version uint16) string {
+	switch version {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	}
+	return "00"
+}
+
+// First and last character of the ALPN, or of its hex representation if those are not alphanumeric
+func ja4Alpn(alpn string) string {
+	if alpn == "" {
+		return "00"
+	}
+
+	alphanumeric := func(c byte) bool {
+		return (c >= '0' && c <= '9') || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')
+	}
+	if !alphanumeric(alpn[0]) || !alphanumeric(alpn[len(alpn)-1]) {
+		alpn = hex.EncodeToString([]byte(alpn))
+	}
+	return alpn[:1] + alpn[len(alpn)-1:]
+}
+
+func ja4Count(count int) string {
+	return fmt.Sprintf("%02d", min(count, 99))
+}
+
+// Truncated SHA256 of the hex values joined by ","
+func ja4Hash(values []uint16, suffix string) string {
+	if len(values) == 0 && suffix == "" {
+		return "000000000000"
+	}
+
+	parts := make([]string, len(values))
+	for i, value := range values {
+		parts[i] = fmt.Sprintf("%04x", value)
+	}
+	text := strings.Join(parts, ",")
+	if suffix != "" {
+		text += "_" + suffix
+	}
+
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func (hello *tlsClientHello) ja4() string {
+	version := hello.version
+	if versions := tlsWithoutGrease(hello.versions); len(versions) != 0 {
+		version = versions[0]
+		for _, v := range versions {
+			version = max(version, v)
+		}
+	}
+
+	sni := "i"
+	if hello.sni != "" {
+		sni = "d"
+	}
+
+	alpn := ""
+	if len(hello.alpn) != 0 {
+		alpn = hello.alpn[0]
+	}
+
+	ciphers := tlsWithoutGrease(hello.ciphers)
+	extensions := tlsWithoutGrease(hello.extensions)
+	a := "t" + ja4Version(version) + sni + ja4Count(len(ciphers)) + ja4Count(len(extensions)) + ja4Alpn(alpn)
+
+	sort.Slice(ciphers, func(i, j int) bool { return ciphers[i] < ciphers[j] })
+
+	// SNI and ALPN are already part of the first section
+	sorted := []uint16{}
+	for _, extension := range extensions {
+		if extension != tlsExtensionServerName && extension != tlsExtensionAlpn {
+			sorted = append(sorted, extension)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	signatures := ""
+	if len(hello.signatureAlgorithms) != 0 {
+		parts := make([]string, len(hello.signatureAlgorithms))
+		for i, algorithm := range hello.signatureAlgorithms {
+			parts[i] = fmt.Sprintf("%04x", algorithm)
+		}
+		signatures = strings.Join(parts, ",")
+	}
+
+	return a + "_" + ja4Hash(ciphers, "") + "_" + ja4Hash(sorted, signatures)
+}
+
+func (hello *tlsServerHello) ja4s() string {
+	extensions := tlsWithoutGrease(hello.extensions)
+	a := "t" + ja4Version(hello.negotiatedVersion()) + ja4Count(len(extensions)) + ja4Alpn(hello.alpn)
+	return fmt.Sprintf("%s_%04x_%s", a, hello.cipher, ja4Hash(extensions, ""))
+}
+
+/*
+ * Client fingerprints
+ */
+
+// Flows needed on a port before its most common client is considered to be the checker
+const tlsClientSamples = 20
+
+// JA4 fingerprints of the clients seen per service port.
+// The checker talks to every service all the time, so it is the most common client unless
+// the fingerprints are configured with -tls-checker-fingerprints.
+type TlsClientStats struct {
+	mutex  sync.Mutex
+	known  map[string]bool
+	counts map[int]map[string]int
+}
+
+var tlsClients = &TlsClientStats{counts: make(map[int]map[string]int)}
+
+// Comma separated JA3 or JA4 fingerprints of the checker
+func (stats *TlsClientStats) SetKnown(raw string) {
+	stats.known = make(map[string]bool)
+	for _, fingerprint := range strings.Split(raw, ",") {
+		if fingerprint = strings.TrimSpace(fingerprint); fingerprint != "" {
+			stats.known[fingerprint] = true
+		}
+	}
+}
+
+// Whether the client of a flow is not the checker
+func (stats *TlsClientStats) Unusual(port int, metadata *db.FlowTls) bool {
+	if len(stats.known) != 0 {
+		return !stats.known[metadata.Ja4] && !stats.known[metadata.Ja3]
+	}
+
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	counts, ok := stats.counts[port]
+	if !ok {
+		counts = make(map[string]int)
+		stats.counts[port] = counts
+	}
+	counts[metadata.Ja4]++
+
+	total, usual, usualCount := 0, "", 0
+	for fingerprint, count := range counts {
+		total += count
+		if count > usualCount || (count == usualCount && fingerprint < usual) {
+			usual, usualCount = fingerprint, count
+		}
+	}
+
+	return total >= tlsClientSamples && metadata.Ja4 != usual
+}
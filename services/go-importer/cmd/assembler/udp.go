@@ -3,6 +3,10 @@ package main
 import (
 	"go-importer/internal/pkg/db"
 
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 	"net/netip"
 
@@ -11,39 +15,43 @@ import (
 )
 
 type UdpAssembler struct {
-	Streams map[UdpStreamIdendifier]*UdpStream
+	Streams            map[UdpStreamIdendifier]*UdpStream
+	Rules              map[uint16]UdpSessionRule
+	DefaultRule        UdpSessionRule
+	reassemblyCallback func(db.FlowEntry)
 }
 
-func NewUdpAssembler() UdpAssembler {
+func NewUdpAssembler(reassemblyCallback func(db.FlowEntry)) UdpAssembler {
 	return UdpAssembler{
-		Streams: map[UdpStreamIdendifier]*UdpStream{},
+		Streams:            map[UdpStreamIdendifier]*UdpStream{},
+		Rules:              map[uint16]UdpSessionRule{},
+		reassemblyCallback: reassemblyCallback,
 	}
 }
 
-func (assembler *UdpAssembler) Assemble(flow gopacket.Flow, udp *layers.UDP, captureInfo *gopacket.CaptureInfo, source string) *UdpStream {
-	endpointSrc := flow.Src().FastHash()
-	endpointDst := flow.Dst().FastHash()
+func (assembler *UdpAssembler) Assemble(flow gopacket.Flow, udp *layers.UDP, captureInfo *gopacket.CaptureInfo, source string, tunnel []db.FlowTunnel) *UdpStream {
+	endpointSrc, endpointDst := flow.Endpoints()
 	portSrc := uint16(udp.SrcPort)
 	portDst := uint16(udp.DstPort)
-	id := UdpStreamIdendifier{}
 
-	if endpointSrc > endpointDst {
-		id.EndpointLower = endpointDst
-		id.EndpointUpper = endpointSrc
+	// Both directions of a conversation have to map to the same identifier,
+	// so order the (address, port) pairs, never the addresses and ports separately
+	var id UdpStreamIdendifier
+	if endpointDst.LessThan(endpointSrc) || (endpointDst == endpointSrc && portDst < portSrc) {
+		id = UdpStreamIdendifier{endpointDst, portDst, endpointSrc, portSrc}
 	} else {
-		id.EndpointLower = endpointSrc
-		id.EndpointUpper = endpointDst
+		id = UdpStreamIdendifier{endpointSrc, portSrc, endpointDst, portDst}
 	}
 
-	if portSrc > portDst {
-		id.PortLower = portDst
-		id.PortUpper = portSrc
-	} else {
-		id.PortLower = portSrc
-		id.PortUpper = portDst
+	stream, ok := assembler.Streams[id]
+	if ok && stream.ShouldSplit(assembler.Rule(stream), udp, captureInfo) {
+		if entry := stream.CompleteReassembly(); entry != nil {
+			assembler.reassemblyCallback(*entry)
+		}
+		ok = false
 	}
 
-	stream, ok := assembler.Streams[id]
+	// Whoever sent the first packet is the client
 	if !ok {
 		stream = &UdpStream{
 			Identifier: id,
@@ -51,6 +59,8 @@ func (assembler *UdpAssembler) Assemble(flow gopacket.Flow, udp *layers.UDP, cap
 			PortSrc:    udp.SrcPort,
 			PortDst:    udp.DstPort,
 			Source:     source,
+			Tunnel:     tunnel,
+			Limiter:    NewFlowLimiter(captureInfo.Timestamp, flow, uint16(udp.SrcPort), uint16(udp.DstPort)),
 		}
 
 		assembler.Streams[id] = stream
@@ -60,6 +70,14 @@ func (assembler *UdpAssembler) Assemble(flow gopacket.Flow, udp *layers.UDP, cap
 	return stream
 }
 
+// Rule for the service port of the stream, falling back to the default rule
+func (assembler *UdpAssembler) Rule(stream *UdpStream) UdpSessionRule {
+	if rule, ok := assembler.Rules[uint16(stream.PortDst)]; ok {
+		return rule
+	}
+	return assembler.DefaultRule
+}
+
 func (assembler *UdpAssembler) CompleteOlderThan(threshold time.Time) []*db.FlowEntry {
 	flows := make([]*db.FlowEntry, 0)
 
@@ -77,22 +95,115 @@ func (assembler *UdpAssembler) CompleteOlderThan(threshold time.Time) []*db.Flow
 }
 
 type UdpStreamIdendifier struct {
-	EndpointLower uint64
-	EndpointUpper uint64
+	EndpointLower gopacket.Endpoint
 	PortLower     uint16
+	EndpointUpper gopacket.Endpoint
 	PortUpper     uint16
 }
 
+// Describes when a new packet starts a new flow instead of being added to the
+// current one. Zero values disable the respective rule.
+type UdpSessionRule struct {
+	// Maximum gap between two packets of one flow
+	Idle       time.Duration
+	// Maximum number of packets in one flow
+	MaxPackets uint
+	// Start a new flow for every DNS query with a new transaction id
+	Dns        bool
+}
+
+// Parse rules in the format of -udp-session-rules, e.g. "53:dns,1234:idle=2s,*:packets=1000"
+func (assembler *UdpAssembler) ParseRules(raw string) error {
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		port, option, ok := strings.Cut(part, ":")
+		if !ok {
+			return fmt.Errorf("missing port in rule %q", part)
+		}
+
+		var number uint64
+		rule := assembler.DefaultRule
+		if port != "*" {
+			var err error
+			number, err = strconv.ParseUint(port, 10, 16)
+			if err != nil {
+				return fmt.Errorf("invalid port in rule %q: %w", part, err)
+			}
+			rule = assembler.Rules[uint16(number)]
+		}
+
+		name, value, _ := strings.Cut(option, "=")
+		switch name {
+		case "idle":
+			idle, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("invalid idle duration in rule %q: %w", part, err)
+			}
+			rule.Idle = idle
+		case "packets":
+			packets, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return fmt.Errorf("invalid packet count in rule %q: %w", part, err)
+			}
+			rule.MaxPackets = uint(packets)
+		case "dns":
+			rule.Dns = true
+		default:
+			return fmt.Errorf("unknown rule %q", part)
+		}
+
+		if port == "*" {
+			assembler.DefaultRule = rule
+		} else {
+			assembler.Rules[uint16(number)] = rule
+		}
+	}
+
+	return nil
+}
+
 type UdpStream struct {
 	Identifier  UdpStreamIdendifier
 	Flow        gopacket.Flow
 	PacketCount uint
 	PacketSize  uint
+	SizeClient  uint
+	SizeServer  uint
+	Limiter     FlowLimiter
 	Items       []db.FlowItem
 	PortSrc     layers.UDPPort
 	PortDst     layers.UDPPort
 	Source      string
+	Tunnel      []db.FlowTunnel
 	LastSeen    time.Time
+	DnsId       int
+}
+
+// Check whether this packet belongs to a new session according to the rule
+func (stream *UdpStream) ShouldSplit(rule UdpSessionRule, udp *layers.UDP, captureInfo *gopacket.CaptureInfo) bool {
+	if stream.PacketCount == 0 {
+		return false
+	}
+
+	if rule.Idle != 0 && captureInfo.Timestamp.Sub(stream.LastSeen) > rule.Idle {
+		return true
+	}
+
+	if rule.MaxPackets != 0 && stream.PacketCount >= rule.MaxPackets {
+		return true
+	}
+
+	// A query (QR bit not set) with a transaction id we have not seen yet
+	if rule.Dns && len(udp.Payload) >= 12 && udp.Payload[2] & 0x80 == 0 {
+		id := int(binary.BigEndian.Uint16(udp.Payload[0:2]))
+		return stream.DnsId != id
+	}
+
+	return false
 }
 
 func (stream *UdpStream) ProcessSegment(flow gopacket.Flow, udp *layers.UDP, captureInfo *gopacket.CaptureInfo) {
@@ -101,28 +212,31 @@ func (stream *UdpStream) ProcessSegment(flow gopacket.Flow, udp *layers.UDP, cap
 	}
 
 	from := "s"
-	if flow.Dst().FastHash() == stream.Flow.Src().FastHash() {
+	if flow.Src() == stream.Flow.Src() && udp.SrcPort == stream.PortSrc {
 		from = "c"
 	}
 
+	if len(udp.Payload) >= 12 && from == "c" {
+		stream.DnsId = int(binary.BigEndian.Uint16(udp.Payload[0:2]))
+	}
+
 	stream.LastSeen = captureInfo.Timestamp
 	stream.PacketCount += 1
 	stream.PacketSize += uint(len(udp.Payload))
 
-	// We have to make sure to stay under the document limit
-	available := uint(*maxFlowItemSize * 1024 * 1024) - stream.PacketSize
-	length := uint(len(udp.Payload))
-	if length > available {
-		length = available
-	}
-	if length < 0 {
-		length = 0
+	offset := &stream.SizeServer
+	if from == "c" {
+		offset = &stream.SizeClient
 	}
 
+	// We have to make sure to stay under the document limit
+	data := stream.Limiter.Fit(from, int(*offset), udp.Payload)
+	*offset += uint(len(udp.Payload))
+
 	stream.Items = append(stream.Items, db.FlowItem{
 		Kind: "raw",
 		From: from,
-		Data: udp.Payload[:length],
+		Data: data,
 		Time: captureInfo.Timestamp,
 	})
 }
@@ -144,6 +258,11 @@ func (stream *UdpStream) CompleteReassembly() *db.FlowEntry {
 		}
 	}
 
+	tags := []string{"udp"}
+	if stream.Limiter.Truncated {
+		tags = append(tags, "truncated")
+	}
+
 	return &db.FlowEntry{
 		Src_port:    uint16(stream.PortSrc),
 		Dst_port:    uint16(stream.PortDst),
@@ -154,10 +273,14 @@ func (stream *UdpStream) CompleteReassembly() *db.FlowEntry {
 		Num_packets: int(stream.PacketCount),
 		Parent_id:   nil,
 		Child_id:    nil,
-		Tags:        []string{"udp"},
+		Tags:        tags,
 		Filename:    stream.Source,
 		Flow:        stream.Items,
 		Size:        int(stream.PacketSize),
+		Size_Client: int64(stream.SizeClient),
+		Size_Server: int64(stream.SizeServer),
+		Overflow:    stream.Limiter.Overflow,
+		Tunnel:      stream.Tunnel,
 		Flags:       make([]string, 0),
 		Flagids:     make([]string, 0),
 	}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"go-importer/internal/pkg/db"
+
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Negotiated permessage-deflate extension
+type websocketDeflate struct {
+	enabled         bool
+	clientNoContext bool
+	serverNoContext bool
+}
+
+func parseWebsocketDeflate(extensions string) websocketDeflate {
+	deflate := websocketDeflate{}
+	for _, extension := range strings.Split(extensions, ",") {
+		params := strings.Split(extension, ";")
+		if strings.TrimSpace(params[0]) != "permessage-deflate" {
+			continue
+		}
+
+		deflate.enabled = true
+		for _, param := range params[1:] {
+			name, _, _ := strings.Cut(strings.TrimSpace(param), "=")
+			switch name {
+			case "client_no_context_takeover":
+				deflate.clientNoContext = true
+			case "server_no_context_takeover":
+				deflate.serverNoContext = true
+			}
+		}
+	}
+	return deflate
+}
+
+const (
+	websocketOpcodeContinuation = 0x0
+	websocketOpcodeControl      = 0x8
+)
+
+// Window of the deflate compressor, the dictionary for the next message
+const websocketDeflateWindow = 32 * 1024
+
+// Reassembles the messages of one direction of a websocket connection
+type websocketParser struct {
+	from     string
+	compress bool
+	// Every message is compressed on its own
+	noContext bool
+	// Last decompressed bytes, used as the dictionary of the next message
+	window []byte
+	buffer []byte
+
+	// Fragmented message being assembled
+	fragments  []byte
+	opcode     int
+	compressed bool
+	item       int
+	time       time.Time
+
+	messages []websocketMessage
+}
+
+type websocketMessage struct {
+	// Flow item in which the message started, used to order the messages of both directions
+	item int
+	db.FlowItem
+}
+
+// Feed the data of the next flow item of this direction
+func (parser *websocketParser) Feed(item int, itemTime time.Time, data []byte) error {
+	parser.buffer = append(parser.buffer, data...)
+
+	for {
+		header, payload, ok := parser.nextFrame()
+		if !ok {
+			return nil
+		}
+
+		fin := header&0x80 != 0
+		rsv1 := header&0x40 != 0
+		opcode := int(header & 0x0f)
+
+		// Control frames can be sent in between fragments
+		if opcode&websocketOpcodeControl != 0 {
+			parser.emit(item, itemTime, opcode, payload)
+			continue
+		}
+
+		if opcode != websocketOpcodeContinuation {
+			if len(parser.fragments) != 0 {
+				return errors.New("websocket message started before the previous one ended")
+			}
+			parser.opcode = opcode
+			parser.compressed = rsv1
+			parser.item = item
+			parser.time = itemTime
+		} else if parser.opcode == websocketOpcodeContinuation {
+			return errors.New("websocket continuation without a message")
+		}
+
+		parser.fragments = append(parser.fragments, payload...)
+		if len(parser.fragments) > *maxFlowItemSize*1024*1024 {
+			return errors.New("websocket message too large")
+		}
+
+		if !fin {
+			continue
+		}
+
+		message := parser.fragments
+		if parser.compressed && parser.compress {
+			var err error
+			if message, err = parser.inflate(message); err != nil {
+				return err
+			}
+		}
+
+		parser.emit(parser.item, parser.time, parser.opcode, message)
+		parser.fragments = nil
+		parser.opcode = websocketOpcodeContinuation
+	}
+}
+
+// Take the next complete frame from the buffer, returning its first header byte and unmasked payload
+func (parser *websocketParser) nextFrame() (byte, []byte, bool) {
+	buffer := parser.buffer
+	if len(buffer) < 2 {
+		return 0, nil, false
+	}
+
+	masked := buffer[1]&0x80 != 0
+	length := uint64(buffer[1] & 0x7f)
+	offset := 2
+
+	switch length {
+	case 126:
+		if len(buffer) < offset+2 {
+			return 0, nil, false
+		}
+		length = uint64(binary.BigEndian.Uint16(buffer[offset:]))
+		offset += 2
+	case 127:
+		if len(buffer) < offset+8 {
+			return 0, nil, false
+		}
+		length = binary.BigEndian.Uint64(buffer[offset:])
+		offset += 8
+	}
+
+	var mask []byte
+	if masked {
+		if len(buffer) < offset+4 {
+			return 0, nil, false
+		}
+		mask = buffer[offset : offset+4]
+		offset += 4
+	}
+
+	if uint64(len(buffer)-offset) < length {
+		return 0, nil, false
+	}
+
+	end := offset + int(length)
+	payload := append([]byte{}, buffer[offset:end]...)
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+
+	parser.buffer = buffer[end:]
+	return buffer[0], payload, true
+}
+
+func (parser *websocketParser) inflate(message []byte) ([]byte, error) {
+	if parser.noContext {
+		parser.window = nil
+	}
+
+	// The sender strips the empty block at the end of every message
+	message = append(message, 0x00, 0x00, 0xff, 0xff)
+	reader := flate.NewReaderDict(bytes.NewReader(message), parser.window)
+	defer reader.Close()
+
+	// Limit the reader to prevent potential decompression bombs
+	decoded, err := io.ReadAll(io.LimitReader(reader, int64(*maxFlowItemSize*1024*1024)))
+	// The stream is never finished, so running out of data is expected
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+
+	parser.window = append(parser.window, decoded...)
+	if len(parser.window) > websocketDeflateWindow {
+		parser.window = parser.window[len(parser.window)-websocketDeflateWindow:]
+	}
+
+	return decoded, nil
+}
+
+func (parser *websocketParser) emit(item int, itemTime time.Time, opcode int, data []byte) {
+	parser.messages = append(parser.messages, websocketMessage{item, db.FlowItem{
+		Kind: "websocket",
+		From: parser.from,
+		Data: data,
+		Time: itemTime,
+		Meta: db.FlowItemMeta{Opcode: opcode},
+	}})
+}
+
+// Add every websocket message of an upgraded connection as its own "websocket" flow item.
+// Frames are unmasked, fragmented messages joined and permessage-deflate decompressed.
+func ParseWebsocketFlow(flow *db.FlowEntry, upgrade *httpUpgrade, itemRebuilt []bool) {
+	starts := map[string]httpOffset{"c": upgrade.client, "s": upgrade.server}
+	messages := []websocketMessage{}
+	kind := flowDataKind(flow)
+
+	for from, start := range starts {
+		parser := websocketParser{
+			from:      from,
+			compress:  upgrade.deflate.enabled,
+			noContext: (from == "c" && upgrade.deflate.clientNoContext) || (from == "s" && upgrade.deflate.serverNoContext),
+			opcode:    websocketOpcodeContinuation,
+		}
+
+		for i := start.item; i < len(flow.Flow); i++ {
+			item := flow.Flow[i]
+			if item.Kind != kind || item.From != from {
+				continue
+			}
+
+			// There is no way to find the next frame after missing data
+			if item.Meta.Gap != nil {
+				break
+			}
+
+			data := item.Data
+			if i == start.item {
+				data = data[start.resolve(itemRebuilt):]
+			}
+
+			if err := parser.Feed(i, item.Time, data); err != nil {
+				break
+			}
+		}
+
+		messages = append(messages, parser.messages...)
+	}
+
+	if len(messages) == 0 {
+		return
+	}
+
+	// Flow items alternate between the directions, so this keeps the conversation in order
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].item < messages[j].item
+	})
+
+	items := make([]db.FlowItem, len(messages))
+	for i, message := range messages {
+		items[i] = message.FlowItem
+	}
+	appendFlowItems(flow, items)
+
+	if !contains(flow.Tags, "websocket") {
+		flow.Tags = append(flow.Tags, "websocket")
+	}
+}
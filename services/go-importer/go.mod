@@ -1,6 +1,6 @@
 module go-importer
 
-go 1.19
+go 1.22
 
 require (
 	github.com/andybalholm/brotli v1.0.4
@@ -11,8 +11,12 @@ require (
 	github.com/google/gopacket v1.1.19
 	github.com/jackc/pgx-gofrs-uuid v0.0.0-20230224015001-1d428863c2e2
 	github.com/jackc/pgx/v5 v5.4.3
+	github.com/klauspost/compress v1.18.0
 	github.com/tidwall/gjson v1.14.1
 	github.com/vmihailenco/msgpack/v5 v5.3.5
+	golang.org/x/crypto v0.9.0
+	golang.org/x/net v0.10.0
+	google.golang.org/protobuf v1.36.6
 )
 
 require (
@@ -23,8 +27,6 @@ require (
 	github.com/tidwall/match v1.1.1 // indirect
 	github.com/tidwall/pretty v1.2.0 // indirect
 	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
-	golang.org/x/crypto v0.9.0 // indirect
-	golang.org/x/net v0.10.0 // indirect
 	golang.org/x/sync v0.1.0 // indirect
 	golang.org/x/sys v0.8.0 // indirect
 	golang.org/x/text v0.9.0 // indirect
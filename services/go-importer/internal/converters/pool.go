@@ -46,6 +46,15 @@ var serviceConfig = map[int][][]string{
 	},
 }
 
+// Same as serviceConfig, but selected by the protocol the assembler detected for the flow
+// (see DetectProtocol). Only used for flows whose port has no entry in serviceConfig.
+// Empty by default, e.g. to decode all protobuf flows:
+//
+//	"protobuf": {
+//		{"protobuf"},
+//	},
+var protocolConfig = map[string][][]string{}
+
 var workerPool = map[string][]*Process{}
 var workerAccessCounter = map[string]*uint64{}
 
@@ -71,6 +80,13 @@ func StartWorkers(workerCountPerConverter int) {
 			}
 		}
 	}
+	for _, protocol := range protocolConfig {
+		for _, stages := range protocol {
+			for _, converter := range stages {
+				converters[converter] = true
+			}
+		}
+	}
 
 	for converter := range converters {
 		var zero uint64 = 0
@@ -10,13 +10,16 @@ import (
 func RunPipeline(g_db *db.Database, entry *db.FlowEntry) {
 	// TODO: should we also check src port?
 	config, ok := serviceConfig[int(entry.Dst_port)]
+	if !ok {
+		config, ok = protocolConfig[entry.Protocol]
+	}
 	if !ok {
 		return
 	}
 
 	for _, converters := range config {
 		// Split flows into groups by their kinds
-		var flows map[string][]db.FlowItem
+		flows := make(map[string][]db.FlowItem)
 		for _, item := range entry.Flow {
 			_, ok := flows[item.Kind]
 			if !ok {
@@ -101,8 +104,13 @@ func TryConverter(converter string, entry *db.FlowEntry, flow []db.FlowItem) ([]
 			return
 		}
 
+		// Converters do not have to keep the time of their chunks
 		if len(flow) != 0 {
-			streamChunks[len(streamChunks)].Time = flow[0].Time
+			for i := range streamChunks {
+				if streamChunks[i].Time.IsZero() {
+					streamChunks[i].Time = flow[0].Time
+				}
+			}
 		}
 
 		ch <- nil
@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"log"
 	"net/netip"
+	"reflect"
 	"runtime"
 	"sync"
 	"time"
@@ -27,7 +28,10 @@ type Database struct {
 	batcherFlowIndex *CopyBatcher
 	knownTags map[string]struct{}
 	knownTagsMutex *sync.RWMutex
-	fingerprints [][]int32
+	tagRules []TagRule
+	tagRulesVersion int
+	tagRulesMutex *sync.RWMutex
+	fingerprints []fingerprintsPending
 	fingerprintsMutex *sync.Mutex
 	suricataIdWindow time.Duration
 }
@@ -65,12 +69,16 @@ func NewDatabase(connectionString string) *Database {
 			"id", "port_src", "port_dst", "ip_src", "ip_dst", "duration", "tags",
 			"flags", "flagids", "pcap_id", "link_child_id", "link_parent_id",
 			"fingerprints", "packets_count", "packets_size", "flags_in", "flags_out",
+			"size_client", "size_server", "overflow", "tunnel", "http", "tls", "dns", "protocol",
+			"team_src", "team_dst", "confidence", "tcp_fingerprint",
+			"close_reason", "handshake", "retransmissions", "out_of_order",
+			"tick", "flag_ticks",
 		},
 	})
 	database.batcherFlowItem = NewCopyBatcher(CopyBatcherConfig {
 		db: database,
 		tableName: pgx.Identifier{"flow_item"},
-		columns: []string{"id", "flow_id", "kind", "direction", "data"},
+		columns: []string{"id", "flow_id", "kind", "direction", "data", "meta"},
 		batchSize: 2000,
 	})
 	database.batcherFlowIndex = NewCopyBatcher(CopyBatcherConfig {
@@ -95,9 +103,15 @@ func NewDatabase(connectionString string) *Database {
 	database.knownTagsMutex = &sync.RWMutex{}
 	database.knownTags = make(map[string]struct{})
 	database.KnownTagsUpdate()
+
+	// Tagging rules
+	// Reloaded together with the known tags, so they can be edited while running
+	database.tagRulesMutex = &sync.RWMutex{}
+	database.TagRulesUpdate()
 	go func() {
 		for range time.Tick(5 * time.Second) {
 			database.KnownTagsUpdate()
+			database.TagRulesUpdate()
 		}
 	}()
 
@@ -257,7 +271,7 @@ type FlowEntry struct {
 	PcapId       uuid.UUID `db:"pcap_id"`
 	Parent_id    *uuid.UUID `db:"link_parent_id"`
 	Child_id     *uuid.UUID `db:"link_child_id"`
-	Fingerprints []uint32
+	Fingerprints []uint64
 	Flow         []FlowItem `db:"-"`
 	Tags         []string `db:"tags"`
 	Flags        []string `db:"flags"`
@@ -266,6 +280,136 @@ type FlowEntry struct {
 	Size         int `db:"packets_size"`
 	Flags_In     int `db:"flags_in"`
 	Flags_Out    int `db:"flags_out"`
+	Size_Client  int64 `db:"size_client"`
+	Size_Server  int64 `db:"size_server"`
+	Overflow     []FlowOverflow `db:"overflow"`
+	Tunnel       []FlowTunnel `db:"tunnel"`
+	Http         []FlowHttpExchange `db:"http"`
+	Tls          *FlowTls `db:"tls"`
+	Dns          []FlowDnsMessage `db:"dns"`
+	/// Detected from the content, empty for flows without data
+	Protocol     string `db:"protocol"`
+	/// Teams of the source and destination address, see ApplyTeams
+	Team_src     *int `db:"team_src"`
+	Team_dst     *int `db:"team_dst"`
+	/// Confidence of the checker / attack tag, see ApplyClassifier
+	Confidence   *float64 `db:"confidence"`
+	/// Stack of the client, nil if its SYN was not captured
+	Tcp_fingerprint *FlowTcpFingerprint `db:"tcp_fingerprint"`
+	/// How the TCP connection ended, "fin", "rst", "timeout" or "reused" when a new
+	/// connection took over its 4-tuple, empty for other flows
+	Close_reason    string `db:"close_reason"`
+	/// Whether the SYN and SYN-ACK were both captured
+	Handshake       bool `db:"handshake"`
+	/// Segments repeating data that was already seen
+	Retransmissions int `db:"retransmissions"`
+	/// Segments that arrived before the data preceding them
+	Out_of_order    int `db:"out_of_order"`
+	/// Tick in which the flow started and the ticks in which its flags first
+	/// appeared, see ApplyTick
+	Tick            *int `db:"tick"`
+	Flag_ticks      map[string]int `db:"flag_ticks"`
+}
+
+// Data that did not fit into the flow items, see -overflow-dir
+type FlowOverflow struct {
+	Direction string `json:"direction"`
+	Path      string `json:"path"`
+	/// Position of the first byte in the byte stream of its direction
+	Offset    int64 `json:"offset"`
+	Size      int64 `json:"size"`
+}
+
+// Encapsulation the flow was captured in, outermost first
+type FlowTunnel struct {
+	/// One of "vlan", "gre", "vxlan", "geneve" or "ip" (IP-in-IP)
+	Type string `json:"type"`
+	/// Addresses of the IP header carrying the tunnel, empty for VLAN tags
+	Src  string `json:"src,omitempty"`
+	Dst  string `json:"dst,omitempty"`
+	/// VLAN id, GRE key or VNI
+	Id   uint32 `json:"id,omitempty"`
+}
+
+// One HTTP request and its response, see ParseHttpFlow
+// Either side may be missing if it was not captured or not parsable
+type FlowHttpExchange struct {
+	Method      string `json:"method,omitempty"`
+	Host        string `json:"host,omitempty"`
+	Path        string `json:"path,omitempty"`
+	Query       map[string][]string `json:"query,omitempty"`
+	UserAgent   string `json:"user_agent,omitempty"`
+	/// Names of the cookies sent with the request
+	Cookies     []string `json:"cookies,omitempty"`
+	Status      int `json:"status,omitempty"`
+	/// Names of the cookies set by the response
+	SetCookies  []string `json:"set_cookies,omitempty"`
+	/// Content type of the response
+	ContentType string `json:"content_type,omitempty"`
+	/// Length of the (decoded) response body
+	Length      int64 `json:"length"`
+}
+
+// TLS handshake of the flow, see ParseTlsFlow
+type FlowTls struct {
+	Sni          string `json:"sni,omitempty"`
+	/// Protocols offered by the client and the one chosen by the server
+	Alpn         []string `json:"alpn,omitempty"`
+	AlpnSelected string `json:"alpn_selected,omitempty"`
+	/// Versions offered by the client and the negotiated one
+	Versions     []string `json:"versions,omitempty"`
+	Version      string `json:"version,omitempty"`
+	/// Cipher suites offered by the client and the negotiated one
+	Ciphers      []string `json:"ciphers,omitempty"`
+	Cipher       string `json:"cipher,omitempty"`
+	Ja3          string `json:"ja3,omitempty"`
+	Ja3s         string `json:"ja3s,omitempty"`
+	Ja4          string `json:"ja4,omitempty"`
+	Ja4s         string `json:"ja4s,omitempty"`
+}
+
+// One DNS message, see ParseDnsFlow
+type FlowDnsMessage struct {
+	Id        uint16 `json:"id"`
+	Response  bool `json:"response"`
+	/// Response code, only set for responses
+	Rcode     string `json:"rcode,omitempty"`
+	Questions []FlowDnsRecord `json:"questions,omitempty"`
+	Answers   []FlowDnsRecord `json:"answers,omitempty"`
+	/// UDP payload size of the EDNS OPT record, 0 without one
+	EdnsSize  uint16 `json:"edns_size,omitempty"`
+}
+
+type FlowDnsRecord struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Ttl  uint32 `json:"ttl,omitempty"`
+	/// Record data in presentation format, empty for questions
+	Data string `json:"data,omitempty"`
+}
+
+// Passive fingerprint of the SYN of the client, see NewTcpFingerprint
+type FlowTcpFingerprint struct {
+	/// p0f raw signature, ver:ttl+distance:olen:mss:wsize,scale:olayout:quirks:pclass
+	Signature  string `json:"signature"`
+	/// IP version, 4 or 6
+	Version    int `json:"version"`
+	/// TTL (hop limit for IPv6) of the packet and the initial TTL it was likely sent with
+	Ttl        uint8 `json:"ttl"`
+	InitialTtl uint8 `json:"initial_ttl"`
+	/// Length of the IPv4 options
+	IpOptions  int `json:"ip_options"`
+	/// Maximum segment size, 0 without the option
+	Mss        uint16 `json:"mss"`
+	Window     uint16 `json:"window"`
+	/// Window scale, 0 without the option
+	Scale      uint8 `json:"scale"`
+	/// Kinds of the TCP options in order, e.g. "mss,sok,ts,nop,ws"
+	Options    string `json:"options"`
+	/// Oddities of the headers in the notation of p0f, e.g. "df" or "id+"
+	Quirks     []string `json:"quirks"`
+	/// Whether the SYN carries data
+	Payload    bool `json:"payload"`
 }
 
 type FlowItem struct {
@@ -278,6 +422,26 @@ type FlowItem struct {
 	Data []byte `msgpack:"-"`
 	/// Timestamp of the first packet in the flow
 	Time time.Time
+	/// Additional information about this item
+	Meta FlowItemMeta `db:"meta"`
+}
+
+// Stored as jsonb, so keep the unused fields empty
+type FlowItemMeta struct {
+	/// Set on empty marker items, describes data that was never captured
+	Gap *FlowGap `json:"gap,omitempty"`
+	/// Packet boundaries within Data as (byte offset, microseconds since Time) pairs,
+	/// only recorded when segment timing is enabled
+	Segments [][2]int64 `json:"segments,omitempty"`
+	/// Websocket opcode of "websocket" items (1 text, 2 binary, 8 close, 9 ping, 10 pong)
+	Opcode int `json:"opcode,omitempty"`
+}
+
+type FlowGap struct {
+	/// Position of the gap in the byte stream of its direction
+	Offset int `json:"offset"`
+	/// Number of missing bytes, -1 if unknown (e.g. mid-stream pickup)
+	Size int `json:"size"`
 }
 
 // Flows are either coming from a file, in which case we'll dedupe them by pcap file name.
@@ -301,6 +465,23 @@ func (db *Database) FlowInsert(flow FlowEntry) {
 		})
 	}
 
+	// Store empty lists instead of json null
+	if flow.Overflow == nil {
+		flow.Overflow = []FlowOverflow{}
+	}
+	if flow.Tunnel == nil {
+		flow.Tunnel = []FlowTunnel{}
+	}
+	if flow.Http == nil {
+		flow.Http = []FlowHttpExchange{}
+	}
+	if flow.Dns == nil {
+		flow.Dns = []FlowDnsMessage{}
+	}
+	if flow.Flag_ticks == nil {
+		flow.Flag_ticks = map[string]int{}
+	}
+
 	// Fallback to filename for pcap id
 	pcap_id := flow.PcapId
 	if pcap_id == uuid.Nil {
@@ -355,6 +536,7 @@ func (db *Database) FlowInsert(flow FlowEntry) {
 			flow.Flow[i].Kind,
 			flow.Flow[i].From,
 			&flow.Flow[i].Data,
+			flow.Flow[i].Meta,
 		}
 	}
 
@@ -369,16 +551,13 @@ func (db *Database) FlowInsert(flow FlowEntry) {
 			return
 		}
 
-		// Fingerprints are uint32, but psql only has signed integer types
-		// So we make them into int32, instead of using a larger psql int
-		fingerprints := make([]int32, len(flow.Fingerprints))
+		// Fingerprints are uint64, but psql only has signed integer types
+		// So we make them into int64, the bits are all that matters
+		fingerprints := make([]int64, len(flow.Fingerprints))
 		for i, fingerprint := range flow.Fingerprints {
-			fingerprints[i] = int32(fingerprint)
+			fingerprints[i] = int64(fingerprint)
 		}
 
-		// Push fingerprints for async flow connecting
-		db.FingerprintsPush(fingerprints)
-
 		// Now insert the flow
 		db.batcherFlowEntry.PushCallback([]any {
 			flow_id,
@@ -398,10 +577,33 @@ func (db *Database) FlowInsert(flow FlowEntry) {
 			flow.Size,
 			flow.Flags_In,
 			flow.Flags_Out,
+			flow.Size_Client,
+			flow.Size_Server,
+			flow.Overflow,
+			flow.Tunnel,
+			flow.Http,
+			flow.Tls,
+			flow.Dns,
+			flow.Protocol,
+			flow.Team_src,
+			flow.Team_dst,
+			flow.Confidence,
+			flow.Tcp_fingerprint,
+			flow.Close_reason,
+			flow.Handshake,
+			flow.Retransmissions,
+			flow.Out_of_order,
+			flow.Tick,
+			flow.Flag_ticks,
 		}, func(err error) {
 			if err != nil {
 				log.Println("Error inserting flow: ", err)
+				return
 			}
+
+			// Push fingerprints for async flow connecting
+			// Only now the flow exists and can be linked
+			db.FingerprintsPush(flow_id, fingerprints)
 		})
 	})
 }
@@ -499,96 +701,6 @@ type Signature struct {
 	Action  string `json:"action"`
 }
 
-// Fingerprints
-func (db *Database) FingerprintsPush(fingerprints []int32) {
-	if len(fingerprints) == 0 {
-		return
-	}
-
-	db.fingerprintsMutex.Lock()
-	defer db.fingerprintsMutex.Unlock()
-	db.fingerprints = append(db.fingerprints, fingerprints)
-}
-
-func (db *Database) FingerprintsFlush() {
-	db.fingerprintsMutex.Lock()
-
-	if len(db.fingerprints) == 0 {
-		db.fingerprintsMutex.Unlock()
-		return
-	}
-
-	fingerprintsMap := make(map[int32]struct{})
-	for _, ff := range db.fingerprints {
-		if len(ff) > 1 {
-			for _, f := range ff {
-				fingerprintsMap[f] = struct{}{}
-			}
-		}
-	}
-
-	var fingerprintsUnique []int32
-	for f := range fingerprintsMap {
-		fingerprintsUnique = append(fingerprintsUnique, f)
-	}
-
-	fingerprintsJson, _ := json.Marshal(db.fingerprints)
-	db.fingerprints = nil
-	db.fingerprintsMutex.Unlock()
-
-	// INDEX: Primary on fingerprint.id
-	_, err := db.pool.Exec(context.Background(), `
-		INSERT INTO fingerprint (id, grp)
-		SELECT jsonb_array_elements(v.value)::int, coalesce(f.grp, v.value[0]::int)
-			FROM jsonb_array_elements(@fingerprints) AS v
-			LEFT JOIN fingerprint AS f
-				ON f.id = ANY(ARRAY(SELECT value::int FROM jsonb_array_elements(v.value)))
-		ON CONFLICT (id) DO NOTHING
-	`, pgx.NamedArgs {
-		"fingerprints": fingerprintsJson,
-	})
-
-	if err != nil {
-		log.Println("Error inserting fingerprints: ", err)
-	}
-
-	// INDEX: Primary on fingerprint.id
-	// INDEX: Btree on fingerprint.grp
-	// INDEX: Gin on flow.fingerprints
-	cmd, err := db.pool.Exec(context.Background(), `
-		UPDATE flow AS ff
-			SET link_parent_id = d.parent,
-			link_child_id = d.child
-		FROM (
-			SELECT f.id, lag(f.id) OVER (w) AS parent, lead(f.id) OVER (w) AS child
-			FROM flow AS f
-			INNER JOIN fingerprint AS fp
-				ON fp.grp = (SELECT grp FROM fingerprint AS fpp WHERE fpp.id = f.fingerprints[1])
-			WHERE fp.id = ANY(@fingerprints)
-			GROUP BY f.id, fp.grp
-			WINDOW w AS (PARTITION BY fp.grp ORDER BY f.id)
-			ORDER BY fp.grp, f.id
-		) AS d
-		WHERE d.id = ff.id
-			AND (
-				d.child != link_child_id
-				OR d.parent != link_parent_id
-				OR (d.child IS NULL) != (link_child_id IS NULL)
-				OR (d.parent IS NULL) != (link_parent_id IS NULL)
-			)
-	`, pgx.NamedArgs {
-		"fingerprints": fingerprintsUnique,
-	})
-
-	if err != nil {
-		log.Println("Error linking flows: ", err)
-	}
-
-	if cmd.RowsAffected() != 0 {
-		log.Printf("Linked %d flows\n", cmd.RowsAffected())
-	}
-}
-
 // Flag ids
 type FlagId struct {
 	Id int32
@@ -609,3 +721,51 @@ func (db *Database) FlagIdsQuery(lifetime int) ([]FlagId, error) {
 
 	return pgx.CollectRows(rows, pgx.RowToStructByName[FlagId])
 }
+
+// Tagging rules
+// Rules are managed in the tag_rule table, the enabled ones are
+// periodically reloaded, see Database::TagRulesUpdate
+type TagRule struct {
+	Id int32
+	Tag string
+	/// Either a regex or a byte pattern is set
+	Regex *string
+	Bytes []byte
+	/// "c" or "s" to only match data of the client or server, empty for both
+	Direction string
+	/// Server port the rule is limited to, nil for all services
+	Port *int32
+	Priority int32
+}
+
+func (db *Database) TagRulesUpdate() {
+	// Highest priority first, this is also the order of their tags
+	rows, _ := db.pool.Query(context.Background(), `
+		SELECT id, tag, regex, bytes, direction, port, priority
+		FROM tag_rule
+		WHERE enabled
+		ORDER BY priority DESC, id ASC
+	`)
+	defer rows.Close()
+
+	rules, err := pgx.CollectRows(rows, pgx.RowToStructByName[TagRule])
+	if err != nil {
+		log.Println("Error updating tag rules: ", err)
+		return
+	}
+
+	db.tagRulesMutex.Lock()
+	defer db.tagRulesMutex.Unlock()
+
+	if !reflect.DeepEqual(rules, db.tagRules) {
+		db.tagRules = rules
+		db.tagRulesVersion++
+	}
+}
+
+// Current rules and a version that increases whenever they change
+func (db *Database) TagRules() ([]TagRule, int) {
+	db.tagRulesMutex.RLock()
+	defer db.tagRulesMutex.RUnlock()
+	return db.tagRules, db.tagRulesVersion
+}
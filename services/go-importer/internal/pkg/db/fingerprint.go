@@ -0,0 +1,451 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"sort"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/jackc/pgx/v5"
+)
+
+// Flow waiting to be linked to other flows of its session
+type fingerprintsPending struct {
+	flow         uuid.UUID
+	fingerprints []int64
+}
+
+// Fingerprints
+func (db *Database) FingerprintsPush(flow uuid.UUID, fingerprints []int64) {
+	if len(fingerprints) == 0 {
+		return
+	}
+
+	db.fingerprintsMutex.Lock()
+	defer db.fingerprintsMutex.Unlock()
+	db.fingerprints = append(db.fingerprints, fingerprintsPending{flow, fingerprints})
+}
+
+// Link the pushed flows to the other flows of their sessions.
+//
+// Fingerprints are grouped in the fingerprint table and every group remembers
+// the newest flow linked into it (its tail) in fingerprint_group. The flows of a
+// group form a chain ordered by time. New flows are inserted into that chain
+// walking back from its tail, so usually only the new flows and the old tail are
+// touched, no matter how large a group grows during a game. Flows that finish
+// late, like long TCP connections, walk back a bit further.
+//
+// A flow with fingerprints of multiple groups bridges two sessions. Those groups
+// are merged into one and their chains are joined in time order.
+func (db *Database) FingerprintsFlush() {
+	db.fingerprintsMutex.Lock()
+	pending := db.fingerprints
+	db.fingerprints = nil
+	db.fingerprintsMutex.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+
+	linked, err := db.fingerprintsLink(pending)
+	if err != nil {
+		log.Println("Error linking flows: ", err)
+		return
+	}
+
+	if linked != 0 {
+		log.Printf("Linked %d flows\n", linked)
+	}
+}
+
+func uuidLess(a uuid.UUID, b uuid.UUID) bool {
+	return bytes.Compare(a.Bytes(), b.Bytes()) < 0
+}
+
+func (db *Database) fingerprintsLink(pending []fingerprintsPending) (int, error) {
+	ctx := context.Background()
+
+	// Flow ids start with their time, so this links flows in the order they happened
+	sort.Slice(pending, func(i, j int) bool {
+		return uuidLess(pending[i].flow, pending[j].flow)
+	})
+
+	fingerprints := []int64{}
+	for _, p := range pending {
+		fingerprints = append(fingerprints, p.fingerprints...)
+	}
+
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Groups of the fingerprints we have already seen
+	// INDEX: Primary on fingerprint.id
+	known := make(map[int64]int64)
+	var id, grp int64
+	rows, _ := tx.Query(ctx, `
+		SELECT id, grp
+		FROM fingerprint
+		WHERE id = ANY(@fingerprints)
+	`, pgx.NamedArgs {
+		"fingerprints": fingerprints,
+	})
+	_, err = pgx.ForEachRow(rows, []any{&id, &grp}, func() error {
+		known[id] = grp
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// Merged groups point to the group they were merged into
+	merged := make(map[int64]int64)
+	find := func(grp int64) int64 {
+		for {
+			next, ok := merged[grp]
+			if !ok {
+				return grp
+			}
+			grp = next
+		}
+	}
+
+	groups := make([]int64, len(pending))
+	involved := []int64{}
+	newIds, newGroups := []int64{}, []int64{}
+	for i, p := range pending {
+		found := false
+		for _, fingerprint := range p.fingerprints {
+			other, ok := known[fingerprint]
+			if !ok {
+				continue
+			}
+
+			other = find(other)
+			if !found {
+				grp, found = other, true
+			} else if other != grp {
+				// Bridge between two sessions, any of the two ids works for the merged group
+				if other < grp {
+					grp, other = other, grp
+				}
+				merged[other] = grp
+			}
+		}
+
+		if !found {
+			// Completely new session, name the group after its first fingerprint
+			grp = p.fingerprints[0]
+		}
+
+		for _, fingerprint := range p.fingerprints {
+			if _, ok := known[fingerprint]; !ok {
+				known[fingerprint] = grp
+				newIds = append(newIds, fingerprint)
+				newGroups = append(newGroups, grp)
+			}
+		}
+
+		groups[i] = grp
+		involved = append(involved, grp)
+	}
+
+	// Tails of the groups, including the ones about to be merged
+	// INDEX: Primary on fingerprint_group.grp
+	tails := make(map[int64]uuid.UUID)
+	var tail uuid.UUID
+	rows, _ = tx.Query(ctx, `
+		SELECT grp, tail
+		FROM fingerprint_group
+		WHERE grp = ANY(@groups)
+		FOR UPDATE
+	`, pgx.NamedArgs {
+		"groups": append(involved, mapKeys(merged)...),
+	})
+	_, err = pgx.ForEachRow(rows, []any{&grp, &tail}, func() error {
+		tails[grp] = tail
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// Merge groups bridged by the new flows
+	if len(merged) != 0 {
+		from, to := []int64{}, []int64{}
+		for other := range merged {
+			from = append(from, other)
+			to = append(to, find(other))
+		}
+
+		// INDEX: Btree on fingerprint.grp
+		_, err = tx.Exec(ctx, `
+			UPDATE fingerprint AS f
+				SET grp = m.to_grp
+			FROM unnest(@from::bigint[], @to::bigint[]) AS m(from_grp, to_grp)
+			WHERE f.grp = m.from_grp
+		`, pgx.NamedArgs {
+			"from": from,
+			"to": to,
+		})
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = tx.Exec(ctx, `
+			DELETE FROM fingerprint_group
+			WHERE grp = ANY(@from)
+		`, pgx.NamedArgs {
+			"from": from,
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// Insert fingerprints we have not seen before
+	for i := range newGroups {
+		newGroups[i] = find(newGroups[i])
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO fingerprint (id, grp)
+		SELECT * FROM unnest(@ids::bigint[], @groups::bigint[])
+		ON CONFLICT (id) DO NOTHING
+	`, pgx.NamedArgs {
+		"ids": newIds,
+		"groups": newGroups,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// Every group is merged from the chain of each group it absorbed and its new flows
+	walk := func(flow uuid.UUID) ([]uuid.UUID, bool, error) {
+		return fingerprintsWalk(ctx, tx, flow)
+	}
+	chains := make(map[int64][]*fingerprintChain)
+	for grp, tail := range tails {
+		target := find(grp)
+		chains[target] = append(chains[target], newFingerprintChain(tail, walk))
+	}
+	added := make(map[int64]*fingerprintChain)
+	// Newest first, pending is sorted by id
+	for i := len(pending) - 1; i >= 0; i-- {
+		grp := find(groups[i])
+		chain, ok := added[grp]
+		if !ok {
+			chain = &fingerprintChain{done: true}
+			added[grp] = chain
+			chains[grp] = append(chains[grp], chain)
+		}
+		chain.flows = append(chain.flows, pending[i].flow)
+	}
+
+	parents := make(map[uuid.UUID]uuid.UUID)
+	children := make(map[uuid.UUID]uuid.UUID)
+	link := func(parent uuid.UUID, child uuid.UUID) {
+		parents[child] = parent
+		children[parent] = child
+	}
+	tailGroups, tailIds := []int64{}, []uuid.UUID{}
+	for grp, groupChains := range chains {
+		tail, err := fingerprintsMerge(groupChains, link)
+		if err != nil {
+			return 0, err
+		}
+		tailGroups = append(tailGroups, grp)
+		tailIds = append(tailIds, tail)
+	}
+
+	parentIds, parentValues := []uuid.UUID{}, []uuid.UUID{}
+	for child, parent := range parents {
+		parentIds = append(parentIds, child)
+		parentValues = append(parentValues, parent)
+	}
+	// INDEX: Primary on flow.id
+	_, err = tx.Exec(ctx, `
+		UPDATE flow AS f
+			SET link_parent_id = l.parent
+		FROM unnest(@ids::uuid[], @parents::uuid[]) AS l(id, parent)
+		WHERE f.id = l.id
+	`, pgx.NamedArgs {
+		"ids": parentIds,
+		"parents": parentValues,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	childIds, childValues := []uuid.UUID{}, []uuid.UUID{}
+	for parent, child := range children {
+		childIds = append(childIds, parent)
+		childValues = append(childValues, child)
+	}
+	_, err = tx.Exec(ctx, `
+		UPDATE flow AS f
+			SET link_child_id = l.child
+		FROM unnest(@ids::uuid[], @children::uuid[]) AS l(id, child)
+		WHERE f.id = l.id
+	`, pgx.NamedArgs {
+		"ids": childIds,
+		"children": childValues,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// Remember the new tails
+	_, err = tx.Exec(ctx, `
+		INSERT INTO fingerprint_group (grp, tail)
+		SELECT * FROM unnest(@groups::bigint[], @tails::uuid[])
+		ON CONFLICT (grp) DO UPDATE
+			SET tail = excluded.tail
+	`, pgx.NamedArgs {
+		"groups": tailGroups,
+		"tails": tailIds,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(parents), tx.Commit(ctx)
+}
+
+// Number of flows read at once when walking a chain
+const fingerprintsWalkLimit = 64
+
+// Flows of a chain linked before the given one, newest first, and whether the
+// walk reached the first flow of the chain
+func fingerprintsWalk(ctx context.Context, tx pgx.Tx, flow uuid.UUID) ([]uuid.UUID, bool, error) {
+	// INDEX: Primary on flow.id
+	rows, _ := tx.Query(ctx, `
+		WITH RECURSIVE chain AS (
+			SELECT p.id, p.link_parent_id, 1 AS depth
+			FROM flow AS f
+			INNER JOIN flow AS p
+				ON p.id = f.link_parent_id
+			WHERE f.id = @flow
+			UNION ALL
+			SELECT p.id, p.link_parent_id, c.depth + 1
+			FROM chain AS c
+			INNER JOIN flow AS p
+				ON p.id = c.link_parent_id
+			WHERE c.depth < @limit
+		)
+		SELECT id, link_parent_id
+		FROM chain
+		ORDER BY depth
+	`, pgx.NamedArgs {
+		"flow": flow,
+		"limit": fingerprintsWalkLimit,
+	})
+
+	flows := []uuid.UUID{}
+	var id uuid.UUID
+	var parent uuid.NullUUID
+	_, err := pgx.ForEachRow(rows, []any{&id, &parent}, func() error {
+		flows = append(flows, id)
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return flows, len(flows) < fingerprintsWalkLimit || !parent.Valid, nil
+}
+
+// Flows of a group linked from parent to child, read backwards from the newest one
+type fingerprintChain struct {
+	// Newest first
+	flows []uuid.UUID
+	// Whether the flows are linked to each other already, new flows are not
+	linked bool
+	// Whether flows is all that is left of the chain
+	done bool
+	// Oldest flow read so far, walking continues before it
+	oldest uuid.UUID
+	walk   func(uuid.UUID) ([]uuid.UUID, bool, error)
+}
+
+func newFingerprintChain(tail uuid.UUID, walk func(uuid.UUID) ([]uuid.UUID, bool, error)) *fingerprintChain {
+	return &fingerprintChain{
+		flows:  []uuid.UUID{tail},
+		linked: true,
+		oldest: tail,
+		walk:   walk,
+	}
+}
+
+// Newest flow left in the chain, false once it is empty
+func (chain *fingerprintChain) peek() (uuid.UUID, bool, error) {
+	if len(chain.flows) == 0 && !chain.done {
+		flows, done, err := chain.walk(chain.oldest)
+		if err != nil {
+			return uuid.Nil, false, err
+		}
+		chain.flows, chain.done = flows, done || len(flows) == 0
+		if len(flows) != 0 {
+			chain.oldest = flows[len(flows)-1]
+		}
+	}
+
+	if len(chain.flows) == 0 {
+		return uuid.Nil, false, nil
+	}
+	return chain.flows[0], true, nil
+}
+
+// Merge the chains into one, ordered by flow id and so by time. Flows are taken
+// from the newest end of the chains until a single linked chain is left, whose
+// older part is in order already and stays as it is. Usually that is right after
+// the new flows, unless a flow arrived late or two long sessions were merged.
+// Only links that change are passed to link. Returns the tail of the merged chain.
+func fingerprintsMerge(chains []*fingerprintChain, link func(parent uuid.UUID, child uuid.UUID)) (uuid.UUID, error) {
+	tail, next := uuid.Nil, uuid.Nil
+	// Chain the next flow was taken from
+	var nextChain *fingerprintChain
+	for {
+		var newest *fingerprintChain
+		var flow uuid.UUID
+		left := 0
+		for _, chain := range chains {
+			candidate, ok, err := chain.peek()
+			if err != nil {
+				return uuid.Nil, err
+			}
+			if !ok {
+				continue
+			}
+			left++
+			if newest == nil || uuidLess(flow, candidate) {
+				newest, flow = chain, candidate
+			}
+		}
+
+		if newest == nil {
+			return tail, nil
+		}
+
+		if next == uuid.Nil {
+			tail = flow
+		} else if nextChain != newest || !newest.linked {
+			link(flow, next)
+		}
+
+		if left == 1 && newest.linked {
+			return tail, nil
+		}
+		newest.flows = newest.flows[1:]
+		next, nextChain = flow, newest
+	}
+}
+
+func mapKeys(m map[int64]int64) []int64 {
+	keys := make([]int64, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -0,0 +1,344 @@
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Flow ids at the given seconds into the game, in the same order
+func testFlowIds(seconds ...int) []uuid.UUID {
+	start := time.Date(2024, 11, 30, 13, 0, 0, 0, time.UTC)
+	ids := make([]uuid.UUID, len(seconds))
+	for i, second := range seconds {
+		ids[i] = FidCreate(start.Add(time.Duration(second) * time.Second))
+	}
+	return ids
+}
+
+// Chains kept in memory, linked the same way as the flow table
+type testChains struct {
+	parents  map[uuid.UUID]uuid.UUID
+	children map[uuid.UUID]uuid.UUID
+}
+
+func newTestChains(chains ...[]uuid.UUID) *testChains {
+	store := &testChains{map[uuid.UUID]uuid.UUID{}, map[uuid.UUID]uuid.UUID{}}
+	for _, chain := range chains {
+		for i := 1; i < len(chain); i++ {
+			store.link(chain[i-1], chain[i])
+		}
+	}
+	return store
+}
+
+func (store *testChains) link(parent uuid.UUID, child uuid.UUID) {
+	store.parents[child] = parent
+	store.children[parent] = child
+}
+
+// Merge the chains and write the links afterwards, like fingerprintsLink does
+func (store *testChains) merge(t *testing.T, chains ...*fingerprintChain) (uuid.UUID, int) {
+	t.Helper()
+	links := [][2]uuid.UUID{}
+	tail, err := fingerprintsMerge(chains, func(parent uuid.UUID, child uuid.UUID) {
+		links = append(links, [2]uuid.UUID{parent, child})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, link := range links {
+		store.link(link[0], link[1])
+	}
+	return tail, len(links)
+}
+
+// Walks two flows at a time, so the chains are read in several steps
+func (store *testChains) walk(flow uuid.UUID) ([]uuid.UUID, bool, error) {
+	flows := []uuid.UUID{}
+	for len(flows) < 2 {
+		parent, ok := store.parents[flow]
+		if !ok {
+			return flows, true, nil
+		}
+		flows = append(flows, parent)
+		flow = parent
+	}
+	_, more := store.parents[flow]
+	return flows, !more, nil
+}
+
+// Flows of the chain ending in tail, oldest first
+func (store *testChains) chain(tail uuid.UUID) []uuid.UUID {
+	chain := []uuid.UUID{tail}
+	for {
+		parent, ok := store.parents[chain[0]]
+		if !ok {
+			return chain
+		}
+		if store.children[parent] != chain[0] {
+			return append([]uuid.UUID{uuid.Nil}, chain...)
+		}
+		chain = append([]uuid.UUID{parent}, chain...)
+	}
+}
+
+func checkTestChain(t *testing.T, chain []uuid.UUID, expected []uuid.UUID) {
+	t.Helper()
+	if len(chain) != len(expected) {
+		t.Fatalf("chain has %d flows, expected %d", len(chain), len(expected))
+	}
+	for i := range chain {
+		if chain[i] != expected[i] {
+			t.Fatalf("flow %d of the chain is %v, expected %v", i, chain[i], expected[i])
+		}
+	}
+}
+
+func TestFingerprintsMergeLateFlow(t *testing.T) {
+	ids := testFlowIds(1, 2, 3, 4, 5, 6, 7)
+	store := newTestChains(append(ids[:2:2], ids[3:]...))
+
+	// A long connection that started at 3 is only linked now
+	tail, links := store.merge(t,
+		newFingerprintChain(ids[6], store.walk),
+		&fingerprintChain{flows: []uuid.UUID{ids[2]}, done: true},
+	)
+
+	if tail != ids[6] {
+		t.Errorf("tail is %v, expected %v", tail, ids[6])
+	}
+	checkTestChain(t, store.chain(tail), ids)
+	// Only the flows around the late one change
+	if links != 2 {
+		t.Errorf("%d links were written, expected 2", links)
+	}
+}
+
+func TestFingerprintsMergeGroups(t *testing.T) {
+	ids := testFlowIds(1, 2, 3, 4, 5, 6, 7, 8)
+	a := []uuid.UUID{ids[0], ids[2], ids[4]}
+	b := []uuid.UUID{ids[1], ids[3], ids[5]}
+	store := newTestChains(a, b)
+
+	// New flows of the merged group, one of them bridged the two sessions
+	tail, _ := store.merge(t,
+		newFingerprintChain(a[2], store.walk),
+		newFingerprintChain(b[2], store.walk),
+		&fingerprintChain{flows: []uuid.UUID{ids[7], ids[6]}, done: true},
+	)
+
+	checkTestChain(t, store.chain(tail), ids)
+}
+
+func TestFingerprintsMergeAppend(t *testing.T) {
+	ids := testFlowIds(1, 2, 3, 4, 5)
+	store := newTestChains(ids[:3])
+
+	tail, links := store.merge(t,
+		newFingerprintChain(ids[2], func(uuid.UUID) ([]uuid.UUID, bool, error) {
+			t.Fatal("appending walked the chain")
+			return nil, true, nil
+		}),
+		&fingerprintChain{flows: []uuid.UUID{ids[4], ids[3]}, done: true},
+	)
+
+	checkTestChain(t, store.chain(tail), ids)
+	if links != 2 {
+		t.Errorf("%d links were written, expected 2", links)
+	}
+}
+
+// Database in a schema of its own on the Postgres of TULIP_TEST_TIMESCALE,
+// created from services/schema
+func testDatabase(t *testing.T) *Database {
+	t.Helper()
+	connectionString := os.Getenv("TULIP_TEST_TIMESCALE")
+	if connectionString == "" {
+		t.Skip("TULIP_TEST_TIMESCALE is not set")
+	}
+	ctx := context.Background()
+
+	suffix := make([]byte, 6)
+	if _, err := rand.Read(suffix); err != nil {
+		t.Fatal(err)
+	}
+	schema := "tulip_test_" + hex.EncodeToString(suffix)
+
+	config, err := pgxpool.ParseConfig(connectionString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The extensions are in public
+	config.ConnConfig.RuntimeParams["search_path"] = schema + ", public"
+	pool, err := pgxpool.NewWithConfig(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		pool.Exec(ctx, `DROP SCHEMA `+pgx.Identifier{schema}.Sanitize()+` CASCADE`)
+		pool.Close()
+	})
+
+	_, err = pool.Exec(ctx, `CREATE SCHEMA `+pgx.Identifier{schema}.Sanitize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The same files the timescale container is initialized with, the extensions
+	// of system.sql are expected to be installed already
+	for _, file := range []string{"functions.sql", "schema.sql"} {
+		script, err := os.ReadFile(filepath.Join("..", "..", "..", "..", "schema", file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := pool.Exec(ctx, string(script)); err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+	}
+
+	return &Database{pool: pool, fingerprintsMutex: &sync.Mutex{}}
+}
+
+// Insert the flows and link them in one flush
+func testFlush(t *testing.T, database *Database, fingerprints []int64, flows ...uuid.UUID) {
+	t.Helper()
+	_, err := database.pool.Exec(context.Background(), `
+		INSERT INTO flow (id, port_src, port_dst, ip_src, ip_dst, duration, pcap_id)
+		SELECT unnest(@ids::uuid[]), 40000, 1337, '10.0.0.1', '10.0.0.2', '0', gen_random_uuid()
+	`, pgx.NamedArgs{
+		"ids": flows,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, flow := range flows {
+		database.FingerprintsPush(flow, fingerprints)
+	}
+	database.FingerprintsFlush()
+}
+
+// Flows of every chain in the flow table, oldest first
+func testDatabaseChains(t *testing.T, database *Database) [][]uuid.UUID {
+	t.Helper()
+	store := newTestChains()
+	var id uuid.UUID
+	var parent, child uuid.NullUUID
+	rows, _ := database.pool.Query(context.Background(), `
+		SELECT id, link_parent_id, link_child_id
+		FROM flow
+		ORDER BY id
+	`)
+	heads := []uuid.UUID{}
+	_, err := pgx.ForEachRow(rows, []any{&id, &parent, &child}, func() error {
+		if parent.Valid {
+			store.parents[id] = parent.UUID
+		} else {
+			heads = append(heads, id)
+		}
+		if child.Valid {
+			store.children[id] = child.UUID
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chains := [][]uuid.UUID{}
+	for _, head := range heads {
+		chain := []uuid.UUID{head}
+		for {
+			next, ok := store.children[chain[len(chain)-1]]
+			if !ok {
+				break
+			}
+			if store.parents[next] != chain[len(chain)-1] {
+				t.Fatalf("parent of %v does not match its child link", next)
+			}
+			chain = append(chain, next)
+		}
+		chains = append(chains, chain)
+	}
+	return chains
+}
+
+func testDatabaseTails(t *testing.T, database *Database) map[int64]uuid.UUID {
+	t.Helper()
+	tails := map[int64]uuid.UUID{}
+	var grp int64
+	var tail uuid.UUID
+	rows, _ := database.pool.Query(context.Background(), `SELECT grp, tail FROM fingerprint_group`)
+	_, err := pgx.ForEachRow(rows, []any{&grp, &tail}, func() error {
+		tails[grp] = tail
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tails
+}
+
+func TestFingerprintsLinkLateFlowPostgres(t *testing.T) {
+	database := testDatabase(t)
+	ids := testFlowIds(1, 2, 3, 4)
+
+	testFlush(t, database, []int64{1}, ids[0], ids[2])
+	testFlush(t, database, []int64{1}, ids[3])
+	// Flushed after the newer flows, e.g. a UDP flow after its idle timeout
+	testFlush(t, database, []int64{1}, ids[1])
+
+	chains := testDatabaseChains(t, database)
+	if len(chains) != 1 {
+		t.Fatalf("got %d chains, expected 1", len(chains))
+	}
+	checkTestChain(t, chains[0], ids)
+
+	tails := testDatabaseTails(t, database)
+	if len(tails) != 1 || tails[1] != ids[3] {
+		t.Errorf("unexpected tails %v", tails)
+	}
+}
+
+func TestFingerprintsLinkMergePostgres(t *testing.T) {
+	database := testDatabase(t)
+	ids := testFlowIds(1, 2, 3, 4, 5)
+
+	testFlush(t, database, []int64{10}, ids[0], ids[2])
+	testFlush(t, database, []int64{20}, ids[1], ids[3])
+	if chains := testDatabaseChains(t, database); len(chains) != 2 {
+		t.Fatalf("got %d chains before the merge, expected 2", len(chains))
+	}
+
+	// Bridges both sessions
+	testFlush(t, database, []int64{10, 20}, ids[4])
+
+	chains := testDatabaseChains(t, database)
+	if len(chains) != 1 {
+		t.Fatalf("got %d chains, expected 1", len(chains))
+	}
+	checkTestChain(t, chains[0], ids)
+
+	tails := testDatabaseTails(t, database)
+	if len(tails) != 1 || tails[10] != ids[4] {
+		t.Errorf("unexpected tails %v", tails)
+	}
+
+	var groups int
+	err := database.pool.QueryRow(context.Background(), `SELECT count(DISTINCT grp) FROM fingerprint`).Scan(&groups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if groups != 1 {
+		t.Errorf("fingerprints are in %d groups, expected 1", groups)
+	}
+}
@@ -0,0 +1,21 @@
+-- Migrates a database created before flows were linked incrementally
+-- Run once against an existing database, e.g.:
+--   docker compose exec -T timescale psql -U tulip tulip < services/schema/migrations/fingerprint_group.sql
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS fingerprint_group (
+	grp bigint PRIMARY KEY,
+	tail uuid NOT NULL
+);
+
+-- The newest flow of every existing group becomes its tail
+INSERT INTO fingerprint_group (grp, tail)
+SELECT fp.grp, (array_agg(f.id ORDER BY f.id DESC))[1]
+	FROM flow AS f
+	INNER JOIN fingerprint AS fp
+		ON fp.id = f.fingerprints[1]
+	GROUP BY fp.grp
+ON CONFLICT (grp) DO NOTHING;
+
+COMMIT;
@@ -0,0 +1,20 @@
+-- Migrates a database created before fingerprints became 64 bit keyed hashes
+-- Run once against an existing database, e.g.:
+--   docker compose exec -T timescale psql -U tulip tulip < services/schema/migrations/fingerprints_bigint.sql
+--
+-- Old 32 bit fingerprints never match the new ones, so flows captured before the
+-- migration keep their links but are not linked to flows captured after it.
+
+BEGIN;
+
+ALTER TABLE fingerprint
+	ALTER COLUMN id TYPE bigint,
+	ALTER COLUMN grp TYPE bigint;
+
+ALTER TABLE flow
+	ALTER COLUMN fingerprints TYPE bigint[];
+
+-- The old fingerprints are useless for linking new flows
+DELETE FROM fingerprint;
+
+COMMIT;
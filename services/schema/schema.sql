@@ -10,7 +10,37 @@ CREATE TABLE tag (
 INSERT INTO tag (name) VALUES
 	('tcp'),
 	('udp'),
+	('icmp'),
+	('icmpv6'),
+	('sctp'),
+	('ip'),
 	('http'),
+	('websocket'),
+	('http2'),
+	('grpc'),
+	('dns'),
+	('ssh'),
+	('redis'),
+	('mqtt'),
+	('text'),
+	('msgpack'),
+	('protobuf'),
+	('binary'),
+	('tls'),
+	('tls-decrypted'),
+	('tls-unusual'),
+	('gap'),
+	('incomplete'),
+	('truncated'),
+	('rst'),
+	('timeout'),
+	('no-handshake'),
+	('reused'),
+	('own-team'),
+	('enemy'),
+	('gameserver'),
+	('checker'),
+	('attack'),
 	('flag-in'),
 	('flag-out'),
 	('flagid-in'),
@@ -19,6 +49,26 @@ INSERT INTO tag (name) VALUES
 	('suricata'),
 	('starred');
 
+-- Custom tags added by the assembler, changes are picked up while it runs
+-- see ApplyTagRules
+CREATE TABLE tag_rule (
+	id serial PRIMARY KEY,
+	tag text NOT NULL,
+	-- Either a regex (Go syntax) or a byte pattern
+	regex text,
+	bytes bytea,
+	-- 'c' or 's' to only match data of the client or server, '' for both
+	direction text NOT NULL DEFAULT '' CHECK (direction IN ('', 'c', 's')),
+	-- Server port of the service the rule is limited to, NULL for all services
+	port int,
+	-- Rules with a higher priority are listed first in the tags of a flow
+	priority int NOT NULL DEFAULT 0,
+	-- Display color of the tag, e.g. '#ff0000'
+	color text,
+	enabled boolean NOT NULL DEFAULT true,
+	CHECK ((regex IS NULL) != (bytes IS NULL))
+);
+
 -- Flag ids
 CREATE TABLE flag_id (
 	id serial NOT NULL PRIMARY KEY,
@@ -36,13 +86,19 @@ CREATE TABLE pcap (
 );
 
 CREATE TABLE fingerprint (
-	id int PRIMARY KEY,
-	grp int NOT NULL
+	id bigint PRIMARY KEY,
+	grp bigint NOT NULL
 );
 
 -- Fingerprint matching during assembly
 CREATE INDEX ON fingerprint (grp);
 
+-- Newest flow of every fingerprint group, new flows are linked to it
+CREATE TABLE fingerprint_group (
+	grp bigint PRIMARY KEY,
+	tail uuid NOT NULL
+);
+
 CREATE TABLE flow (
 	id uuid NOT NULL PRIMARY KEY,
 	time timestamptz GENERATED ALWAYS AS (fid_unpack_time(id)) STORED,
@@ -57,20 +113,61 @@ CREATE TABLE flow (
 	tags jsonb NOT NULL DEFAULT '[]',
 	flags jsonb NOT NULL DEFAULT '[]',
 	flagids jsonb NOT NULL DEFAULT '[]',
-	fingerprints int[] NOT NULL DEFAULT '{}',
+	fingerprints bigint[] NOT NULL DEFAULT '{}',
 	signatures jsonb NOT NULL DEFAULT '[]',
 	packets_count int NOT NULL DEFAULT 0,
 	packets_size int NOT NULL DEFAULT 0,
 	flags_in int NOT NULL DEFAULT 0,
-	flags_out int NOT NULL DEFAULT 0
+	flags_out int NOT NULL DEFAULT 0,
+	size_client bigint NOT NULL DEFAULT 0,
+	size_server bigint NOT NULL DEFAULT 0,
+	overflow jsonb NOT NULL DEFAULT '[]',
+	tunnel jsonb NOT NULL DEFAULT '[]',
+	http jsonb NOT NULL DEFAULT '[]',
+	tls jsonb,
+	dns jsonb NOT NULL DEFAULT '[]',
+	protocol text NOT NULL DEFAULT '',
+	team_src int,
+	team_dst int,
+	-- Confidence of the checker / attack tag, between 0.5 and 1
+	confidence real,
+	tcp_fingerprint jsonb,
+	-- TCP connection state, see TcpStream::ReassemblyComplete
+	close_reason text NOT NULL DEFAULT '',
+	handshake boolean NOT NULL DEFAULT false,
+	retransmissions int NOT NULL DEFAULT 0,
+	out_of_order int NOT NULL DEFAULT 0,
+	-- Tick in which the flow started and the tick of the first occurrence of each flag,
+	-- see the -ticks option of the assembler
+	tick int,
+	flag_ticks jsonb NOT NULL DEFAULT '{}'
 );
 
 -- Suricata id lookup, see Database::SuricataIdFindFlow
 CREATE INDEX ON flow (id, port_src, port_dst, ip_src, ip_dst);
 -- Tag search
 CREATE INDEX ON flow USING gin (tags);
+-- HTTP exchange search, e.g. http @> '[{"method": "POST", "status": 200}]'
+CREATE INDEX ON flow USING gin (http jsonb_path_ops);
+-- TLS handshake search, e.g. tls @> '{"sni": "example.com"}'
+CREATE INDEX ON flow USING gin (tls jsonb_path_ops);
+-- DNS message search, e.g. dns @> '[{"questions": [{"name": "example.com", "type": "TXT"}]}]'
+CREATE INDEX ON flow USING gin (dns jsonb_path_ops);
 -- Fingerprint matching during assembly
 CREATE INDEX ON flow USING gin (fingerprints);
+-- Protocol filter
+CREATE INDEX ON flow (protocol);
+-- Team filters
+CREATE INDEX ON flow (team_src);
+CREATE INDEX ON flow (team_dst);
+-- Classification filter
+CREATE INDEX ON flow (confidence);
+-- Client stack search, e.g. tcp_fingerprint @> '{"options": "mss,sok,ts,nop,ws", "initial_ttl": 64}'
+CREATE INDEX ON flow USING gin (tcp_fingerprint jsonb_path_ops);
+-- Close reason filter
+CREATE INDEX ON flow (close_reason);
+-- Tick filter
+CREATE INDEX ON flow (tick);
 
 SELECT create_hypertable(
 	'flow',
@@ -85,7 +182,8 @@ CREATE TABLE flow_item (
 	kind text NOT NULL,
 	time timestamptz GENERATED ALWAYS AS (fid_unpack_time(id)) STORED,
 	direction text NOT NULL,
-	data bytea NOT NULL
+	data bytea NOT NULL,
+	meta jsonb NOT NULL DEFAULT '{}'
 );
 
 SELECT create_hypertable(